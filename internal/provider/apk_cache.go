@@ -0,0 +1,488 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chainguard.dev/apko/pkg/build"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// cacheDirEnv names the environment variable that provides the default for
+// the provider's cache_dir.
+const cacheDirEnv = "APKO_CACHE_DIR"
+
+// defaultIndexTTL is how long a cached APKINDEX is used before it is
+// revalidated against the repository.
+const defaultIndexTTL = 5 * time.Minute
+
+// apkCache is a persistent cache of the APKINDEX, APK and key files fetched
+// over HTTP, shared by every Terraform process using the same directory.
+//
+// Contents are stored once by digest under blobs/sha256, and refs/ maps each
+// URL to its blob, with the ref's modification time recording when it was
+// last used. APKs are immutable, so they are served from the cache for as
+// long as they are in it, while indexes and keys are revalidated once they
+// are older than indexTTL. Once the cache grows past maxSize, the least
+// recently used entries are evicted.
+type apkCache struct {
+	dir      string
+	indexTTL time.Duration
+	maxSize  int64
+
+	mu      sync.Mutex
+	written int64 // bytes stored since the last eviction
+}
+
+func newAPKCache(dir string, indexTTL time.Duration, maxSize int64) (*apkCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []string{"blobs/sha256", "refs", "locks"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			return nil, fmt.Errorf("creating cache directory: %w", err)
+		}
+	}
+	return &apkCache{
+		dir:      dir,
+		indexTTL: indexTTL,
+		maxSize:  maxSize,
+	}, nil
+}
+
+// cacheOptions returns the build options for fetching packages, through the
+// provider's cache_dir if it is set, and apko's own disk cache otherwise.
+// When the provider is offline, files are only served from the cache and the
+// offline mirror, and those that are missing are added to missing.
+func (p ProviderOpts) cacheOptions(offline bool, missing *missingFiles) []build.Option {
+	offline = offline || p.offline
+	if p.apkCache == nil && (!offline || p.offlineMirror == "") {
+		return []build.Option{
+			build.WithCache("", offline, p.cache),
+			build.WithTransport(p.fetchTransport()),
+		}
+	}
+	// apko only consults p.cache through its own disk cache, which would
+	// keep a second, unbounded copy of everything in cache_dir and answer
+	// hits without revalidating or marking them as used. The transport
+	// takes its place: concurrent fetches of a URL, in this process or
+	// others, share one download under its lock, and fresh indexes are
+	// answered without a round trip.
+	return []build.Option{
+		build.WithoutDiskCache(),
+		build.WithTransport(&cacheTransport{
+			cache:   p.apkCache,
+			inner:   p.fetchTransport(),
+			offline: offline,
+			mirror:  p.offlineMirror,
+			missing: missing,
+		}),
+	}
+}
+
+// cacheRef records which blob holds the contents of a URL.
+type cacheRef struct {
+	URL     string    `json:"url"`
+	Digest  string    `json:"digest"`
+	Size    int64     `json:"size"`
+	ETag    string    `json:"etag,omitempty"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// cacheKey identifies a URL in the cache. Credentials and query parameters
+// are left out, since they don't change the contents.
+func cacheKey(u *url.URL) (string, string) {
+	k := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	h := sha256.Sum256([]byte(k.String()))
+	return k.String(), hex.EncodeToString(h[:])
+}
+
+// immutable reports whether the contents of a URL never change. APKs are
+// named by version, while indexes and keys are updated in place.
+func immutable(u *url.URL) bool {
+	return strings.HasSuffix(u.Path, ".apk")
+}
+
+func (c *apkCache) refPath(key string) string  { return filepath.Join(c.dir, "refs", key+".json") }
+func (c *apkCache) lockPath(key string) string { return filepath.Join(c.dir, "locks", key+".lock") }
+func (c *apkCache) blobPath(digest string) string {
+	return filepath.Join(c.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (c *apkCache) loadRef(key string) (*cacheRef, bool) {
+	b, err := os.ReadFile(c.refPath(key))
+	if err != nil {
+		return nil, false
+	}
+	var ref cacheRef
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return nil, false
+	}
+	return &ref, true
+}
+
+// storeRef atomically writes ref, which also marks it as just used.
+func (c *apkCache) storeRef(key string, ref *cacheRef) error {
+	b, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.refPath(key), b)
+}
+
+// touch marks a ref as used for the purposes of eviction.
+func (c *apkCache) touch(key string) {
+	now := time.Now()
+	_ = os.Chtimes(c.refPath(key), now, now)
+}
+
+func (c *apkCache) fresh(u *url.URL, ref *cacheRef) bool {
+	return immutable(u) || time.Since(ref.Fetched) < c.indexTTL
+}
+
+// store streams body into a blob, returning its digest and size.
+func (c *apkCache) store(body io.Reader) (string, int64, error) {
+	dir := filepath.Join(c.dir, "blobs", "sha256")
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return "", 0, fmt.Errorf("creating cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("writing cache file: %w", err)
+	}
+
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmp.Name(), c.blobPath(digest)); err != nil {
+		return "", 0, fmt.Errorf("renaming cache file: %w", err)
+	}
+
+	c.mu.Lock()
+	c.written += size
+	c.mu.Unlock()
+	return digest, size, nil
+}
+
+// maybeEvict evicts entries once enough has been written since the last
+// eviction that the cache may have outgrown its cap.
+func (c *apkCache) maybeEvict(ctx context.Context) {
+	if c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	due := c.written > c.maxSize/10
+	if due {
+		c.written = 0
+	}
+	c.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := c.evict(ctx); err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("evicting from apk cache: %v", err))
+	}
+}
+
+// evict removes the least recently used entries until the cache fits within
+// maxSize. Only one process evicts at a time, others skip it. Readers in
+// other processes that lose a blob to eviction fetch it again.
+func (c *apkCache) evict(ctx context.Context) error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	unlock, ok, err := tryLockFile(filepath.Join(c.dir, ".lock"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	type entry struct {
+		key  string
+		ref  *cacheRef
+		used time.Time
+	}
+	var entries []entry
+	refs := map[string]int{}
+	des, err := os.ReadDir(filepath.Join(c.dir, "refs"))
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		key, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok {
+			continue
+		}
+		ref, ok := c.loadRef(key)
+		if !ok {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{key: key, ref: ref, used: fi.ModTime()})
+		refs[ref.Digest]++
+	}
+
+	// Sum up the blobs, removing any that nothing refers to.
+	var total int64
+	sizes := map[string]int64{}
+	dir := filepath.Join(c.dir, "blobs", "sha256")
+	if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		digest := "sha256:" + d.Name()
+		if refs[digest] == 0 {
+			// Leave recent files alone, they may still be being written or
+			// about to be referred to.
+			if time.Since(fi.ModTime()) < time.Hour {
+				return nil
+			}
+			return os.Remove(p)
+		}
+		sizes[digest] = fi.Size()
+		total += fi.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Or(a.used.Compare(b.used), cmp.Compare(a.key, b.key))
+	})
+	var evicted int
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(c.refPath(e.key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		evicted++
+		if refs[e.ref.Digest]--; refs[e.ref.Digest] == 0 {
+			if err := os.Remove(c.blobPath(e.ref.Digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			total -= sizes[e.ref.Digest]
+		}
+	}
+	if evicted != 0 {
+		tflog.Debug(ctx, fmt.Sprintf("evicted %d entries from apk cache, %d bytes remain", evicted, total))
+	}
+	return nil
+}
+
+// cacheTransport serves requests from the cache, if any. When offline, it
+// falls back on the mirror directory rather than inner, and records what
+// neither has in missing.
+type cacheTransport struct {
+	cache   *apkCache
+	inner   http.RoundTripper
+	offline bool
+	mirror  string
+	missing *missingFiles
+	stats   *fetchStats
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// apko smuggles the etag it got from a HEAD request to its own caching
+	// transport in this header, which must not reach the server.
+	if req.Header.Get("I-Cant-Believe-Its-Not-If-None-Match") != "" {
+		req = req.Clone(req.Context())
+		req.Header.Del("I-Cant-Believe-Its-Not-If-None-Match")
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.inner.RoundTrip(req)
+	}
+
+	c := t.cache
+	name, key := cacheKey(req.URL)
+	if c != nil {
+		if ref, ok := c.loadRef(key); ok && (t.offline || c.fresh(req.URL, ref)) {
+			if resp, ok := c.serve(req, key, ref); ok {
+				t.stats.hit(req)
+				return resp, nil
+			}
+		}
+	}
+	if t.offline {
+		if resp, ok := fromMirror(req, t.mirror); ok {
+			return resp, nil
+		}
+		if !optional(req.URL) {
+			t.missing.add(name)
+		}
+		return notCached(req, name), nil
+	}
+	if c == nil {
+		return t.inner.RoundTrip(req)
+	}
+
+	// Hold a lock on the URL while fetching it, so that concurrent builds,
+	// in this process or others, download it once.
+	unlock, err := lockFile(c.lockPath(key))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ref, ok := c.loadRef(key)
+	if ok && c.fresh(req.URL, ref) {
+		if resp, ok := c.serve(req, key, ref); ok {
+			t.stats.hit(req)
+			return resp, nil
+		}
+	}
+
+	// Revalidate a stale entry rather than downloading it again.
+	fetch := req.Clone(req.Context())
+	if ok && ref.ETag != "" {
+		fetch.Header.Set("If-None-Match", ref.ETag)
+	}
+	resp, err := t.inner.RoundTrip(fetch)
+	if err != nil {
+		return nil, err
+	}
+	if ok && (resp.StatusCode == http.StatusNotModified || (req.Method == http.MethodHead && resp.StatusCode == http.StatusOK && ref.ETag != "" && resp.Header.Get("ETag") == ref.ETag)) {
+		resp.Body.Close()
+		ref.Fetched = time.Now()
+		if err := c.storeRef(key, ref); err != nil {
+			return nil, err
+		}
+		if resp, ok := c.serve(req, key, ref); ok {
+			t.stats.hit(req)
+			return resp, nil
+		}
+		// The blob was evicted since we looked, so fetch it again.
+		resp, err = t.inner.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	digest, size, err := func() (string, int64, error) {
+		defer resp.Body.Close()
+		return c.store(resp.Body)
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("caching %s: %w", name, err)
+	}
+	ref = &cacheRef{
+		URL:     name,
+		Digest:  digest,
+		Size:    size,
+		ETag:    resp.Header.Get("ETag"),
+		Fetched: time.Now(),
+	}
+	if err := c.storeRef(key, ref); err != nil {
+		return nil, fmt.Errorf("caching %s: %w", name, err)
+	}
+	t.stats.fetched(size)
+	c.maybeEvict(req.Context())
+
+	served, ok := c.serve(req, key, ref)
+	if !ok {
+		return nil, fmt.Errorf("cached %s disappeared", name)
+	}
+	return served, nil
+}
+
+// serve answers req from the blob of ref, reporting false if it is gone.
+func (c *apkCache) serve(req *http.Request, key string, ref *cacheRef) (*http.Response, bool) {
+	f, err := os.Open(c.blobPath(ref.Digest))
+	if err != nil {
+		return nil, false
+	}
+	c.touch(key)
+	return serveFile(req, f, ref.Size, ref.ETag), true
+}
+
+// serveFile answers req with the contents of f, closing it.
+func serveFile(req *http.Request, f *os.File, size int64, etag string) *http.Response {
+	h := http.Header{}
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		ContentLength: size,
+		Body:          f,
+		Request:       req,
+	}
+	if req.Method == http.MethodHead {
+		f.Close()
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// notCached answers a request that can't be served offline. It is a 404
+// rather than an error, so that it isn't retried.
+func notCached(req *http.Request, name string) *http.Response {
+	return &http.Response{
+		Status:     "404 Not Found (not available offline)",
+		StatusCode: http.StatusNotFound,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(name + " is not in the apk cache\n")),
+		Request:    req,
+	}
+}
+
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
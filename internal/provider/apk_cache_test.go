@@ -0,0 +1,227 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRepo serves files, counting requests by method and honoring
+// If-None-Match against each file's etag.
+type testRepo struct {
+	files map[string]string
+	etags map[string]string
+
+	gets, heads, notModified atomic.Int32
+}
+
+func (r *testRepo) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, ok := r.files[req.URL.Path]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if etag := r.etags[req.URL.Path]; etag != "" {
+		w.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			r.notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if req.Method == http.MethodHead {
+		r.heads.Add(1)
+		return
+	}
+	r.gets.Add(1)
+	io.WriteString(w, body)
+}
+
+// transport returns a RoundTripper that serves requests from the cache,
+// falling back to inner. When offline, misses are answered with a 404
+// instead, which fails without being retried.
+func (c *apkCache) transport(inner http.RoundTripper, offline bool) http.RoundTripper {
+	return &cacheTransport{cache: c, inner: inner, offline: offline}
+}
+
+func testGet(t *testing.T, rt http.RoundTripper, method, url string) (int, string, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip(%s %s) = %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b), resp.Header.Get("ETag")
+}
+
+func TestAPKCachePackages(t *testing.T) {
+	repo := &testRepo{files: map[string]string{"/os/x86_64/foo-1.0-r0.apk": "foo"}}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	u := srv.URL + "/os/x86_64/foo-1.0-r0.apk"
+	for i := range 3 {
+		// A fresh cache each time, as another Terraform process would have.
+		c, err := newAPKCache(dir, time.Hour, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, body, _ := testGet(t, c.transport(http.DefaultTransport, false), http.MethodGet, u); code != http.StatusOK || body != "foo" {
+			t.Errorf("GET #%d = %d %q, want 200 \"foo\"", i, code, body)
+		}
+	}
+	if got := repo.gets.Load(); got != 1 {
+		t.Errorf("repository served %d GETs, want 1", got)
+	}
+}
+
+// TestAPKCacheConcurrent tests that concurrent builds in one process share a
+// single download, as they would through apko's in-memory cache.
+func TestAPKCacheConcurrent(t *testing.T) {
+	repo := &testRepo{files: map[string]string{"/os/x86_64/foo-1.0-r0.apk": "foo"}}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/os/x86_64/foo-1.0-r0.apk", nil)
+			if err != nil {
+				t.Errorf("NewRequest() = %v", err)
+				return
+			}
+			resp, err := c.transport(http.DefaultTransport, false).RoundTrip(req)
+			if err != nil {
+				t.Errorf("RoundTrip() = %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			if b, err := io.ReadAll(resp.Body); err != nil || string(b) != "foo" {
+				t.Errorf("GET = %q, %v, want \"foo\"", b, err)
+			}
+		})
+	}
+	wg.Wait()
+	if got := repo.gets.Load(); got != 1 {
+		t.Errorf("repository served %d GETs, want 1", got)
+	}
+}
+
+func TestAPKCacheIndexRevalidation(t *testing.T) {
+	const index = "/os/x86_64/APKINDEX.tar.gz"
+	repo := &testRepo{
+		files: map[string]string{index: "v1"},
+		etags: map[string]string{index: `"v1"`},
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := c.transport(http.DefaultTransport, false)
+
+	testGet(t, rt, http.MethodGet, srv.URL+index)
+	// Within the TTL, neither HEAD nor GET reach the repository.
+	if code, _, etag := testGet(t, rt, http.MethodHead, srv.URL+index); code != http.StatusOK || etag != `"v1"` {
+		t.Errorf("HEAD = %d %s, want 200 \"v1\"", code, etag)
+	}
+	testGet(t, rt, http.MethodGet, srv.URL+index)
+	if gets, heads := repo.gets.Load(), repo.heads.Load(); gets != 1 || heads != 0 {
+		t.Errorf("repository served %d GETs and %d HEADs, want 1 and 0", gets, heads)
+	}
+
+	// Once stale, the index is revalidated.
+	c.indexTTL = 0
+	if _, body, _ := testGet(t, rt, http.MethodGet, srv.URL+index); body != "v1" {
+		t.Errorf("GET = %q, want \"v1\"", body)
+	}
+	if got := repo.notModified.Load(); got != 1 {
+		t.Errorf("repository served %d 304s, want 1", got)
+	}
+
+	// And fetched again when it has changed.
+	repo.files[index], repo.etags[index] = "v2", `"v2"`
+	if _, body, etag := testGet(t, rt, http.MethodGet, srv.URL+index); body != "v2" || etag != `"v2"` {
+		t.Errorf("GET = %q %s, want \"v2\" \"v2\"", body, etag)
+	}
+}
+
+func TestAPKCacheOffline(t *testing.T) {
+	repo := &testRepo{files: map[string]string{"/os/x86_64/foo-1.0-r0.apk": "foo"}}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := c.transport(http.DefaultTransport, true)
+	if code, body, _ := testGet(t, offline, http.MethodGet, srv.URL+"/os/x86_64/foo-1.0-r0.apk"); code != http.StatusNotFound || !strings.Contains(body, "not in the apk cache") {
+		t.Errorf("offline GET of a missing file = %d %q, want 404", code, body)
+	}
+
+	testGet(t, c.transport(http.DefaultTransport, false), http.MethodGet, srv.URL+"/os/x86_64/foo-1.0-r0.apk")
+	if code, body, _ := testGet(t, offline, http.MethodGet, srv.URL+"/os/x86_64/foo-1.0-r0.apk"); code != http.StatusOK || body != "foo" {
+		t.Errorf("offline GET of a cached file = %d %q, want 200 \"foo\"", code, body)
+	}
+}
+
+func TestAPKCacheEvict(t *testing.T) {
+	repo := &testRepo{files: map[string]string{}}
+	for _, name := range []string{"a", "b", "c"} {
+		repo.files["/os/x86_64/"+name+".apk"] = strings.Repeat(name, 100)
+	}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), 0, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := c.transport(http.DefaultTransport, false)
+
+	// Use a, b and c in order, then a again, so b is the least recently used.
+	base := time.Now().Add(-time.Hour)
+	for i, name := range []string{"a", "b", "c", "a"} {
+		testGet(t, rt, http.MethodGet, srv.URL+"/os/x86_64/"+name+".apk")
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/os/x86_64/"+name+".apk", nil)
+		_, key := cacheKey(req.URL)
+		used := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(c.refPath(key), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.evict(context.Background()); err != nil {
+		t.Fatalf("evict() = %v", err)
+	}
+	for name, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/os/x86_64/"+name+".apk", nil)
+		_, key := cacheKey(req.URL)
+		if _, got := c.loadRef(key); got != want {
+			t.Errorf("%s cached = %t, want %t", name, got, want)
+		}
+	}
+}
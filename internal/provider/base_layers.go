@@ -0,0 +1,166 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	apkotypes "chainguard.dev/apko/pkg/build/types"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// defaultBaseLayersBudget is the layering budget used with base_layers_from
+// when the image doesn't configure one: a layer for the packages shared with
+// the base image, and one for the rest.
+const defaultBaseLayersBudget = 2
+
+type BaseLayersFromModel struct {
+	Config   types.Object `tfsdk:"config"`
+	ImageRef types.String `tfsdk:"image_ref"`
+}
+
+// baseLayers lists the packages of the image named by base_layers_from.
+type baseLayers struct {
+	// packages applies to all architectures, and is set when the base is
+	// given as a config.
+	packages []string
+	// archPackages is set when the base is given as an image, whose
+	// packages may differ between architectures.
+	archPackages map[apkotypes.Architecture][]string
+}
+
+// forArch returns the base packages for arch.
+func (b *baseLayers) forArch(arch apkotypes.Architecture) []string {
+	if b.archPackages == nil {
+		return b.packages
+	}
+	return b.archPackages[arch]
+}
+
+// resolveBaseLayers determines the base packages named by a base_layers_from
+// value, returning nil if it is null.
+func resolveBaseLayers(ctx context.Context, obj types.Object, popts ProviderOpts) (*baseLayers, error) {
+	if obj.IsNull() || obj.IsUnknown() {
+		return nil, nil
+	}
+	var from BaseLayersFromModel
+	if diags := obj.As(ctx, &from, basetypes.ObjectAsOptions{}); diags.HasError() {
+		return nil, fmt.Errorf("reading base_layers_from: %v", diags.Errors())
+	}
+
+	if !from.Config.IsNull() {
+		var ic apkotypes.ImageConfiguration
+		if diags := assignValue(from.Config, &ic); diags.HasError() {
+			return nil, fmt.Errorf("assigning value: %v", diags.Errors())
+		}
+		return &baseLayers{packages: ic.Contents.Packages}, nil
+	}
+
+	ref, err := name.ParseReference(from.ImageRef.ValueString())
+	if err != nil {
+		return nil, fmt.Errorf("parsing base image reference: %w", err)
+	}
+	archPackages, err := popts.imagePackages(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("reading packages of base image %s: %w", ref, err)
+	}
+	return &baseLayers{archPackages: archPackages}, nil
+}
+
+// imagePackages lists the packages of each architecture of an image or index
+// as name=version, preferring the SBOMs attached to the images over
+// downloading their layers.
+func (p ProviderOpts) imagePackages(ctx context.Context, ref name.Reference) (map[apkotypes.Architecture][]string, error) {
+	desc, err := remote.Get(ref, append(p.ropts, remote.WithContext(ctx))...)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[apkotypes.Architecture]v1.Image{}
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		images[platformArchitecture(cf.Platform())] = img
+	} else {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range im.Manifests {
+			if m.Platform == nil || !m.MediaType.IsImage() {
+				continue
+			}
+			if images[platformArchitecture(m.Platform)], err = idx.Image(m.Digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	pkgs := map[apkotypes.Architecture][]string{}
+	for arch, img := range images {
+		h, err := img.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", arch, err)
+		}
+		versions, _, err := p.imagePackageVersions(ctx, ref.Context().Digest(h.String()), img)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", arch, err)
+		}
+		for name, version := range versions {
+			pkgs[arch] = append(pkgs[arch], name+"="+version)
+		}
+		slices.Sort(pkgs[arch])
+	}
+	return pkgs, nil
+}
+
+// platformArchitecture is the inverse of Architecture.ToOCIPlatform.
+func platformArchitecture(p *v1.Platform) apkotypes.Architecture {
+	if p == nil {
+		return ""
+	}
+	if p.Variant != "" {
+		return apkotypes.Architecture(p.Architecture + "/" + p.Variant)
+	}
+	return apkotypes.ParseArchitecture(p.Architecture)
+}
+
+// installedPackages lists the packages in the installed database of img as
+// name=version. Layered images carry partial databases in each layer, so this
+// reads the topmost one, which is complete.
+func installedPackages(img v1.Image) ([]string, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range slices.Backward(layers) {
+		pkgs, err := readInstalled(l)
+		if errors.Is(err, errNoInstalledDB) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			names = append(names, pkg.name+"="+pkg.version)
+		}
+		return names, nil
+	}
+	return nil, errNoInstalledDB
+}
@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	apkotypes "chainguard.dev/apko/pkg/build/types"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestImagePackages(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer srv.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := tarLayer(t, []tar.Header{
+		{Name: "usr/lib/apk/db/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: installedDB, Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{installedDB: testInstalledDB})
+	base, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := func(arch string) v1.Image {
+		img, err := mutate.ConfigFile(base, &v1.ConfigFile{OS: "linux", Architecture: arch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	amd64, arm64 := image("amd64"), image("arm64")
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	if err := remote.WriteIndex(repo.Tag("latest"), idx); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Tag("arm64"), arm64); err != nil {
+		t.Fatal(err)
+	}
+
+	// The amd64 image has an SBOM attached, which is read instead of its
+	// layers.
+	desc, err := partial.Descriptor(amd64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc.Platform = nil
+	sbom, err := mutate.AppendLayers(empty.Image, static.NewLayer([]byte(testSPDX), "application/spdx+json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom = mutate.ConfigMediaType(mutate.MediaType(sbom, ggcrtypes.OCIManifestSchema1), "application/spdx+json")
+	sbom = mutate.Subject(sbom, *desc).(v1.Image)
+	sbomDigest, err := sbom.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Digest(sbomDigest.String()), sbom); err != nil {
+		t.Fatal(err)
+	}
+
+	var popts ProviderOpts
+	for _, tc := range []struct {
+		tag  string
+		want map[apkotypes.Architecture][]string
+	}{{
+		tag: "latest",
+		want: map[apkotypes.Architecture][]string{
+			"amd64": {"foo=1.1-r0"},
+			"arm64": {"bar=2.0-r0", "foo=1.0-r0"},
+		},
+	}, {
+		tag:  "arm64",
+		want: map[apkotypes.Architecture][]string{"arm64": {"bar=2.0-r0", "foo=1.0-r0"}},
+	}} {
+		t.Run(tc.tag, func(t *testing.T) {
+			got, err := popts.imagePackages(ctx, repo.Tag(tc.tag))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("imagePackages() = %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := popts.imagePackages(cctx, repo.Tag("latest")); !errors.Is(err, context.Canceled) {
+		t.Errorf("imagePackages(cancelled) = %v, wanted %v", err, context.Canceled)
+	}
+}
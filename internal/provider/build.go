@@ -8,8 +8,10 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"chainguard.dev/apko/pkg/build"
 	"chainguard.dev/apko/pkg/build/oci"
@@ -20,7 +22,8 @@ import (
 	"github.com/chainguard-dev/clog"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"golang.org/x/sync/errgroup"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -83,7 +86,6 @@ func fromImageData(_ context.Context, ic types.ImageConfiguration, popts Provide
 	}
 
 	opts := []build.Option{
-		build.WithCache("", false, popts.cache),
 		build.WithImageConfiguration(ic),
 		build.WithSBOMGenerators(spdx.New()),
 		build.WithExtraKeys(popts.keyring),
@@ -91,6 +93,7 @@ func fromImageData(_ context.Context, ic types.ImageConfiguration, popts Provide
 		build.WithExtraBuildRepos(popts.buildRespositories),
 		build.WithSizeLimits(toSizeLimits(popts.sizeLimits)),
 	}
+	opts = append(opts, popts.cacheOptions(false, nil)...)
 
 	o, ic2, err := build.NewOptions(opts...)
 	if err != nil {
@@ -110,24 +113,73 @@ func fromImageData(_ context.Context, ic types.ImageConfiguration, popts Provide
 	return o, ic2, nil
 }
 
+// buildOptions holds the resource-level settings that shape a build, as
+// opposed to the provider-level ProviderOpts.
+type buildOptions struct {
+	// verifyReproducible builds each architecture a second time and fails
+	// if the two builds differ.
+	verifyReproducible bool
+
+	// sourceDateEpoch, when set, is used as the build date of every image
+	// and the index instead of the one apko derives from the environment or
+	// the installed packages.
+	sourceDateEpoch *time.Time
+
+	// baseLayers, when set, lists the packages that go in leading layers
+	// shared with a base image, see base_layers_from.
+	baseLayers *baseLayers
+
+	// maxCompressedSize and maxUncompressedSize, when set, fail the build of
+	// any architecture whose image is larger.
+	maxCompressedSize, maxUncompressedSize *int64
+}
+
+// resolveSourceDateEpoch returns the resource's source date epoch, falling
+// back on the provider's when it isn't set.
+func resolveSourceDateEpoch(v basetypes.StringValue, popts ProviderOpts) (*time.Time, error) {
+	if v.IsNull() || v.IsUnknown() {
+		return popts.sourceDateEpoch, nil
+	}
+	t, err := parseSourceDateEpoch(v.ValueString())
+	if err != nil {
+		return nil, fmt.Errorf("parsing source_date_epoch: %w", err)
+	}
+	return &t, nil
+}
+
+// options returns the apko build options implied by the build settings.
+func (b buildOptions) options() []build.Option {
+	if b.sourceDateEpoch == nil {
+		return nil
+	}
+	return []build.Option{build.WithSourceDateEpoch(*b.sourceDateEpoch)}
+}
+
+// buildDateEpoch returns the build date of the image built by bc.
+func (b buildOptions) buildDateEpoch(bc *build.Context) (time.Time, error) {
+	if b.sourceDateEpoch != nil {
+		return *b.sourceDateEpoch, nil
+	}
+	return bc.GetBuildDateEpoch()
+}
+
+// indexBuildDate returns the build date recorded in the index annotations.
+func indexBuildDate(idx v1.ImageIndex) (string, error) {
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return "", fmt.Errorf("reading index manifest: %w", err)
+	}
+	return m.Annotations["org.opencontainers.image.created"], nil
+}
+
 type imagesbom struct {
 	imageHash       v1.Hash
 	predicateType   string
 	predicatePath   string
 	predicateSHA256 string
-}
 
-// writeImageLayout writes the given image index as an OCI image layout to the
-// caller-supplied path. The caller owns the directory lifecycle (e.g. an
-// execroot that is torn down by the build driver).
-func writeImageLayout(dir string, ii v1.ImageIndex) error {
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("create layout dir %q: %w", dir, err)
-	}
-	if _, err := layout.Write(dir, ii); err != nil {
-		return fmt.Errorf("write layout: %w", err)
-	}
-	return nil
+	// The sizes of the layers of the image.
+	compressedSize, uncompressedSize int64
 }
 
 func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.Hash, v1.ImageIndex, map[string]imagesbom, error) {
@@ -149,29 +201,61 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 	if err != nil {
 		return v1.Hash{}, nil, nil, err
 	}
+	bopts, err := data.buildOptions(ctx)
+	if err != nil {
+		return v1.Hash{}, nil, nil, err
+	}
+	if err := data.popts.checkOffline(ic2, ic2.Archs, true); err != nil {
+		return v1.Hash{}, nil, nil, err
+	}
+	lr := newLayerer(ic2, data.popts, bopts.baseLayers)
 
 	// We compute the "build date epoch" of the multi-arch image to be the
 	// maximum "build date epoch" of the per-arch images.  If the user has
 	// explicitly set SOURCE_DATE_EPOCH, that will always trump this
-	// computation.
+	// computation, and an explicit source_date_epoch trumps that.
 	multiArchBDE := o.SourceDateEpoch
+	if bopts.sourceDateEpoch != nil {
+		multiArchBDE = *bopts.sourceDateEpoch
+	}
 
 	var mu sync.Mutex
 	imgs := make(map[types.Architecture]v1.Image, len(ic2.Archs))
 	contexts := make(map[types.Architecture]*build.Context, len(ic2.Archs))
 	sboms := make(map[string]imagesbom, len(ic2.Archs)+1)
 
-	mc, err := build.NewMultiArch(ctx, ic2.Archs, build.WithImageConfiguration(*ic2),
-		build.WithCache("", false, data.popts.cache),
+	mopts := []build.Option{
+		build.WithImageConfiguration(*ic2),
 		build.WithSBOMGenerators(spdx.New()),
 		build.WithSBOM(tempDir),
 		build.WithTempDir(tempDir),
 		build.WithExtraKeys(data.popts.keyring),
 		build.WithExtraBuildRepos(data.popts.buildRespositories),
 		build.WithExtraRepos(data.popts.repositories),
-		build.WithSizeLimits(toSizeLimits(data.popts.sizeLimits)))
+		build.WithSizeLimits(toSizeLimits(data.popts.sizeLimits)),
+	}
+	missing := &missingFiles{}
+	mopts = append(mopts, data.popts.cacheOptions(false, missing)...)
+	mopts = append(mopts, bopts.options()...)
+	mc, err := build.NewMultiArch(ctx, ic2.Archs, mopts...)
 	if err != nil {
-		return v1.Hash{}, nil, nil, err
+		return v1.Hash{}, nil, nil, missing.wrap(err)
+	}
+
+	// To verify reproducibility, set up an identical build in a separate
+	// temporary directory.
+	var verify *build.MultiArch
+	if bopts.verifyReproducible {
+		verifyDir, err := os.MkdirTemp("", "apko-verify-*")
+		if err != nil {
+			return v1.Hash{}, nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(verifyDir)
+
+		verify, err = build.NewMultiArch(ctx, ic2.Archs, append(mopts, build.WithSBOM(verifyDir), build.WithTempDir(verifyDir))...)
+		if err != nil {
+			return v1.Hash{}, nil, nil, err
+		}
 	}
 
 	var errg errgroup.Group
@@ -180,14 +264,24 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 		ctx := clog.WithLogger(ctx, log)
 
 		errg.Go(func() error {
+			release, err := data.popts.acquireBuild(ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+
 			bc := mc.Contexts[arch]
 
-			layers, err := bc.BuildLayers(ctx)
+			layers, err := lr.buildLayers(ctx, bc, tempDir)
 			if err != nil {
 				return fmt.Errorf("building layers for %q: %w", arch, err)
 			}
 
-			bde, err := bc.GetBuildDateEpoch()
+			if err := data.popts.checkPackagePolicy(bc); err != nil {
+				return err
+			}
+
+			bde, err := bopts.buildDateEpoch(bc)
 			if err != nil {
 				return fmt.Errorf("failed to determine build date epoch: %w", err)
 			}
@@ -197,6 +291,11 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 				return fmt.Errorf("failed to build OCI image for %q: %w", arch, err)
 			}
 
+			compressed, uncompressed, err := bopts.checkImageSize(bc, img)
+			if err != nil {
+				return err
+			}
+
 			outputs, err := bc.GenerateImageSBOM(ctx, arch, img)
 			if err != nil {
 				return fmt.Errorf("generating sbom for %s: %w", arch, err)
@@ -207,6 +306,12 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 				return fmt.Errorf("unable to compute digest for %q: %w", arch, err)
 			}
 
+			if verify != nil {
+				if err := verifyReproducible(ctx, verify.Contexts[arch], lr, bopts, img); err != nil {
+					return fmt.Errorf("verifying %q: %w", arch, err)
+				}
+			}
+
 			// We have hardcoded sbom formats to be just "spdx", fail if this isn't right.
 			if len(outputs) != 1 {
 				return fmt.Errorf("saw %d sbom outputs, expected 1", len(outputs))
@@ -248,6 +353,9 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 				predicateType:   "https://spdx.dev/Document",
 				predicatePath:   f.Name(),
 				predicateSHA256: hex.EncodeToString(hash[:]),
+
+				compressedSize:   compressed,
+				uncompressedSize: uncompressed,
 			}
 
 			return nil
@@ -255,7 +363,7 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 	}
 
 	if err := errg.Wait(); err != nil {
-		return v1.Hash{}, nil, nil, err
+		return v1.Hash{}, nil, nil, missing.wrap(err)
 	}
 
 	// generate the index
@@ -319,53 +427,137 @@ func doBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.H
 // This is important for packages that have different dependencies on each architecture, since
 // we can't accurately unify() them.
 func doNewBuild(ctx context.Context, data BuildResourceModel, tempDir string) (v1.Hash, v1.ImageIndex, map[string]imagesbom, error) {
-	byArch := map[string]types.ImageConfiguration{}
+	byArch, err := decodeConfigs(ctx, data.Configs.Elements())
+	if err != nil {
+		return v1.Hash{}, nil, nil, err
+	}
+
+	bopts, err := data.buildOptions(ctx)
+	if err != nil {
+		return v1.Hash{}, nil, nil, err
+	}
+
+	return doBuildFromConfigs(ctx, byArch, data.popts, bopts, tempDir)
+}
 
-	for arch, attr := range data.Configs.Elements() {
+// decodeConfigs decodes the elements of the "configs" map keyed by
+// architecture, normalizing the keys and rejecting any that collide once
+// normalized.
+func decodeConfigs(ctx context.Context, cfgs map[string]attr.Value) (map[string]types.ImageConfiguration, error) {
+	byArch := make(map[string]types.ImageConfiguration, len(cfgs))
+	for arch, val := range cfgs {
 		var obj struct {
 			Config types.ImageConfiguration `tfsdk:"config"`
 		}
-		if diags := assignValue(attr, &obj); diags.HasError() {
-			return v1.Hash{}, nil, nil, fmt.Errorf("assigning value: %v", diags.Errors())
+		if diags := assignValue(val, &obj); diags.HasError() {
+			return nil, fmt.Errorf("assigning value: %v", diags.Errors())
 		}
 
 		ic := obj.Config
 
-		tflog.Trace(ctx, fmt.Sprintf("Got image configuration for %s: %#v", arch, ic))
+		key := normalizeArchKey(arch)
+		if _, exists := byArch[key]; exists {
+			return nil, fmt.Errorf("duplicate arch key: input %q normalizes to %q, which was already provided", arch, key)
+		}
+
+		tflog.Trace(ctx, fmt.Sprintf("Got image configuration for %s: %#v", key, ic))
 
-		byArch[arch] = ic
+		byArch[key] = ic
 	}
+	return byArch, nil
+}
 
-	return doBuildFromConfigs(ctx, byArch, data.popts, tempDir)
+// normalizeArchKey canonicalizes a per-arch config key, leaving the "index"
+// pseudo-architecture untouched.
+func normalizeArchKey(arch string) string {
+	if arch == "index" {
+		return arch
+	}
+	return types.ParseArchitecture(arch).String()
 }
 
-// doBuildRaw builds from raw JSON config strings keyed by architecture.
-func doBuildRaw(ctx context.Context, cfgs map[string]string, popts ProviderOpts, tempDir string) (v1.Hash, v1.ImageIndex, map[string]imagesbom, error) {
+// decodeRawConfigs decodes raw JSON config strings keyed by architecture,
+// normalizing the keys and rejecting any that collide once normalized.
+func decodeRawConfigs(ctx context.Context, cfgs map[string]string) (map[string]types.ImageConfiguration, error) {
 	byArch := make(map[string]types.ImageConfiguration, len(cfgs))
 	for arch, raw := range cfgs {
 		var ic types.ImageConfiguration
 		if err := json.Unmarshal([]byte(raw), &ic); err != nil {
-			return v1.Hash{}, nil, nil, fmt.Errorf("decoding config for %s: %w", arch, err)
+			return nil, fmt.Errorf("decoding config for %s: %w", arch, err)
 		}
 
-		// Normalize arch keys
-		key := arch
-		if arch != "index" {
-			key = types.ParseArchitecture(arch).String()
-		}
+		key := normalizeArchKey(arch)
 		if _, exists := byArch[key]; exists {
-			return v1.Hash{}, nil, nil, fmt.Errorf("duplicate arch key: input %q normalizes to %q, which was already provided", arch, key)
+			return nil, fmt.Errorf("duplicate arch key: input %q normalizes to %q, which was already provided", arch, key)
 		}
 
 		tflog.Trace(ctx, fmt.Sprintf("Got raw image configuration for %s: %#v", key, ic))
 		byArch[key] = ic
 	}
+	return byArch, nil
+}
 
-	return doBuildFromConfigs(ctx, byArch, popts, tempDir)
+// isFullyKnown reports whether the value, including anything nested within
+// it, is known.
+func isFullyKnown(ctx context.Context, v attr.Value) bool {
+	tv, err := v.ToTerraformValue(ctx)
+	if err != nil {
+		return false
+	}
+	return tv.IsFullyKnown()
+}
+
+// checkArchConfigs verifies that the per-arch configs include an "index"
+// entry and a config for every architecture the index declares. It returns
+// the keys that don't match any declared architecture, which the build
+// silently ignores.
+func checkArchConfigs(byArch map[string]types.ImageConfiguration) ([]string, error) {
+	ic, ok := byArch["index"]
+	if !ok {
+		return nil, fmt.Errorf("missing index configuration")
+	}
+
+	// Without explicit architectures the build falls back on the provider's
+	// defaults, which aren't known until the provider is configured.
+	if len(ic.Archs) == 0 {
+		return nil, nil
+	}
+
+	declared := sets.New[string]()
+	var missing []string
+	for _, arch := range ic.Archs {
+		key := normalizeArchKey(arch.String())
+		declared.Insert(key)
+		if _, ok := byArch[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("index declares archs %v, but there is no configuration for %v", sets.List(declared), missing)
+	}
+
+	var extra []string
+	for key := range byArch {
+		if key != "index" && !declared.Has(key) {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	return extra, nil
+}
+
+// doBuildRaw builds from raw JSON config strings keyed by architecture.
+func doBuildRaw(ctx context.Context, cfgs map[string]string, popts ProviderOpts, bopts buildOptions, tempDir string) (v1.Hash, v1.ImageIndex, map[string]imagesbom, error) {
+	byArch, err := decodeRawConfigs(ctx, cfgs)
+	if err != nil {
+		return v1.Hash{}, nil, nil, err
+	}
+
+	return doBuildFromConfigs(ctx, byArch, popts, bopts, tempDir)
 }
 
 // doBuildFromConfigs builds a multi-arch image from pre-decoded per-arch configs.
-func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfiguration, popts ProviderOpts, tempDir string) (v1.Hash, v1.ImageIndex, map[string]imagesbom, error) {
+func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfiguration, popts ProviderOpts, bopts buildOptions, tempDir string) (v1.Hash, v1.ImageIndex, map[string]imagesbom, error) {
 	ic, ok := byArch["index"]
 	if !ok {
 		return v1.Hash{}, nil, nil, fmt.Errorf("missing index configuration")
@@ -381,12 +573,16 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 	// We compute the "build date epoch" of the multi-arch image to be the
 	// maximum "build date epoch" of the per-arch images.  If the user has
 	// explicitly set SOURCE_DATE_EPOCH, that will always trump this
-	// computation.
+	// computation, and an explicit source_date_epoch trumps that.
 	multiArchBDE := o.SourceDateEpoch
+	if bopts.sourceDateEpoch != nil {
+		multiArchBDE = *bopts.sourceDateEpoch
+	}
 
 	var mu sync.Mutex
 	imgs := make(map[types.Architecture]v1.Image, len(ic2.Archs))
 	sboms := make(map[string]imagesbom, len(ic2.Archs)+1)
+	missing := &missingFiles{}
 
 	var errg errgroup.Group
 	for _, arch := range ic2.Archs {
@@ -398,13 +594,23 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 			if !ok {
 				return fmt.Errorf("missing arch %q configuration", arch.String())
 			}
+			release, err := popts.acquireBuild(ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+
 			_, ic2, err := fromImageData(ctx, ic, popts)
 			if err != nil {
 				return fmt.Errorf("failed to convert image data to config %q: %w", arch, err)
 			}
+			if err := popts.checkOffline(ic2, []types.Architecture{arch}, true); err != nil {
+				return err
+			}
+			lr := newLayerer(ic2, popts, bopts.baseLayers)
 
-			bc, err := build.New(ctx, tarfs.New(), build.WithImageConfiguration(*ic2),
-				build.WithCache("", false, popts.cache),
+			opts := []build.Option{
+				build.WithImageConfiguration(*ic2),
 				build.WithSBOMGenerators(spdx.New()),
 				build.WithSBOM(tempDir),
 				build.WithArch(arch),
@@ -412,17 +618,25 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 				build.WithExtraKeys(popts.keyring),
 				build.WithExtraBuildRepos(popts.buildRespositories),
 				build.WithExtraRepos(popts.repositories),
-				build.WithSizeLimits(toSizeLimits(popts.sizeLimits)))
+				build.WithSizeLimits(toSizeLimits(popts.sizeLimits)),
+			}
+			opts = append(opts, popts.cacheOptions(false, missing)...)
+			opts = append(opts, bopts.options()...)
+			bc, err := build.New(ctx, tarfs.New(), opts...)
 			if err != nil {
 				return fmt.Errorf("failed to start apko build: %w", err)
 			}
 
-			layers, err := bc.BuildLayers(ctx)
+			layers, err := lr.buildLayers(ctx, bc, tempDir)
 			if err != nil {
 				return fmt.Errorf("failed to build layer image for %q: %w", arch, err)
 			}
 
-			bde, err := bc.GetBuildDateEpoch()
+			if err := popts.checkPackagePolicy(bc); err != nil {
+				return err
+			}
+
+			bde, err := bopts.buildDateEpoch(bc)
 			if err != nil {
 				return fmt.Errorf("failed to determine build date epoch: %w", err)
 			}
@@ -432,6 +646,11 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 				return fmt.Errorf("failed to build OCI image for %q: %w", arch, err)
 			}
 
+			compressed, uncompressed, err := bopts.checkImageSize(bc, img)
+			if err != nil {
+				return err
+			}
+
 			outputs, err := bc.GenerateImageSBOM(ctx, arch, img)
 			if err != nil {
 				return fmt.Errorf("generating sbom for %s: %w", arch, err)
@@ -442,6 +661,22 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 				return fmt.Errorf("unable to compute digest for %q: %w", arch, err)
 			}
 
+			if bopts.verifyReproducible {
+				verifyDir, err := os.MkdirTemp("", "apko-verify-*")
+				if err != nil {
+					return fmt.Errorf("failed to create temporary directory: %w", err)
+				}
+				defer os.RemoveAll(verifyDir)
+
+				vbc, err := build.New(ctx, tarfs.New(), append(opts, build.WithSBOM(verifyDir), build.WithTempDir(verifyDir))...)
+				if err != nil {
+					return fmt.Errorf("failed to start apko build: %w", err)
+				}
+				if err := verifyReproducible(ctx, vbc, lr, bopts, img); err != nil {
+					return fmt.Errorf("verifying %q: %w", arch, err)
+				}
+			}
+
 			// We have hardcoded sbom formats to be just "spdx", fail if this isn't right.
 			if len(outputs) != 1 {
 				return fmt.Errorf("saw %d sbom outputs, expected 1", len(outputs))
@@ -482,6 +717,9 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 				predicateType:   "https://spdx.dev/Document",
 				predicatePath:   f.Name(),
 				predicateSHA256: hex.EncodeToString(hash[:]),
+
+				compressedSize:   compressed,
+				uncompressedSize: uncompressed,
 			}
 
 			return nil
@@ -489,7 +727,7 @@ func doBuildFromConfigs(ctx context.Context, byArch map[string]types.ImageConfig
 	}
 
 	if err := errg.Wait(); err != nil {
-		return v1.Hash{}, nil, nil, err
+		return v1.Hash{}, nil, nil, missing.wrap(err)
 	}
 
 	// generate the index
@@ -0,0 +1,328 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"chainguard.dev/apko/pkg/build"
+	apkotypes "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/tarfs"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"golang.org/x/sync/errgroup"
+)
+
+// prefetchConcurrency bounds how many packages are downloaded at once.
+const prefetchConcurrency = 8
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &CachePrefetchDataSource{}
+
+func NewCachePrefetchDataSource() datasource.DataSource {
+	return &CachePrefetchDataSource{}
+}
+
+// CachePrefetchDataSource downloads the packages of resolved configs into
+// the provider's cache_dir.
+type CachePrefetchDataSource struct {
+	popts ProviderOpts
+}
+
+// CachePrefetchDataSourceModel describes the data source data model.
+type CachePrefetchDataSourceModel struct {
+	Id           types.String             `tfsdk:"id"`
+	Configs      types.List               `tfsdk:"configs"`
+	BytesFetched int64                    `tfsdk:"bytes_fetched"`
+	FilesFetched int64                    `tfsdk:"files_fetched"`
+	CacheHits    int64                    `tfsdk:"cache_hits"`
+	Packages     []PrefetchedPackageModel `tfsdk:"packages"`
+}
+
+type PrefetchedPackageModel struct {
+	Arch    string `tfsdk:"arch"`
+	Name    string `tfsdk:"name"`
+	Version string `tfsdk:"version"`
+	URL     string `tfsdk:"url"`
+	SHA256  string `tfsdk:"sha256"`
+	Size    int64  `tfsdk:"size"`
+}
+
+func (d *CachePrefetchDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cache_prefetch"
+}
+
+func (d *CachePrefetchDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "This downloads the APKINDEX and APK files needed to build resolved apko configurations into the provider's `cache_dir`, so that later builds can run `offline`.",
+		Attributes: map[string]schema.Attribute{
+			"configs": schema.ListAttribute{
+				MarkdownDescription: "The resolved configurations to prefetch, each the `configs` of an `apko_config` data source.",
+				Required:            true,
+				ElementType:         basetypes.MapType{ElemType: imageConfigurationsSchema},
+			},
+			"bytes_fetched": schema.Int64Attribute{
+				MarkdownDescription: "The number of bytes downloaded into the cache.",
+				Computed:            true,
+			},
+			"files_fetched": schema.Int64Attribute{
+				MarkdownDescription: "The number of files downloaded into the cache.",
+				Computed:            true,
+			},
+			"cache_hits": schema.Int64Attribute{
+				MarkdownDescription: "The number of files that were already in the cache.",
+				Computed:            true,
+			},
+			"packages": schema.ListNestedAttribute{
+				MarkdownDescription: "The packages in the cache, by architecture.",
+				Computed:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"arch": schema.StringAttribute{
+							MarkdownDescription: "The architecture of the package.",
+							Computed:            true,
+						},
+						"name": schema.StringAttribute{
+							MarkdownDescription: "The name of the package.",
+							Computed:            true,
+						},
+						"version": schema.StringAttribute{
+							MarkdownDescription: "The version of the package.",
+							Computed:            true,
+						},
+						"url": schema.StringAttribute{
+							MarkdownDescription: "The URL the package was fetched from.",
+							Computed:            true,
+						},
+						"sha256": schema.StringAttribute{
+							MarkdownDescription: "The SHA256 checksum of the APK file.",
+							Computed:            true,
+						},
+						"size": schema.Int64Attribute{
+							MarkdownDescription: "The size of the APK file in bytes.",
+							Computed:            true,
+						},
+					},
+				},
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "A unique identifier for the set of packages prefetched.",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *CachePrefetchDataSource) Configure(_ context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	popts, ok := req.ProviderData.(*ProviderOpts)
+	if !ok || popts == nil {
+		resp.Diagnostics.AddError("Client Error", "invalid provider data")
+		return
+	}
+	d.popts = *popts
+}
+
+func (d *CachePrefetchDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data CachePrefetchDataSourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if d.popts.apkCache == nil {
+		resp.Diagnostics.AddError("Unable to prefetch", "apko_cache_prefetch requires the provider's cache_dir (or "+cacheDirEnv+") to be set")
+		return
+	}
+	if d.popts.offline {
+		resp.Diagnostics.AddError("Unable to prefetch", "the provider is offline")
+		return
+	}
+
+	var configs []map[string]apkotypes.ImageConfiguration
+	for i, elem := range data.Configs.Elements() {
+		m, ok := elem.(basetypes.MapValue)
+		if !ok {
+			resp.Diagnostics.AddError("Invalid configs", fmt.Sprintf("configs[%d] is a %T, not a map", i, elem))
+			return
+		}
+		byArch, err := decodeConfigs(ctx, m.Elements())
+		if err != nil {
+			resp.Diagnostics.AddError("Invalid configs", fmt.Sprintf("configs[%d]: %v", i, err))
+			return
+		}
+		configs = append(configs, byArch)
+	}
+
+	stats := &fetchStats{}
+	pkgs, err := d.prefetch(ctx, configs, &cacheTransport{
+		cache: d.popts.apkCache,
+		inner: d.popts.fetchTransport(),
+		stats: stats,
+	})
+	if err != nil {
+		resp.Diagnostics.AddError("Unable to prefetch", err.Error())
+		return
+	}
+
+	h := sha256.New()
+	for _, pkg := range pkgs {
+		fmt.Fprintf(h, "%s %s\n", pkg.URL, pkg.SHA256)
+	}
+	data.Id = types.StringValue(hex.EncodeToString(h.Sum(nil)))
+	data.Packages = pkgs
+	data.BytesFetched = stats.bytes.Load()
+	data.FilesFetched = stats.misses.Load()
+	data.CacheHits = stats.hits.Load()
+
+	tflog.Info(ctx, fmt.Sprintf("prefetched %d packages: fetched %d files (%d bytes), %d cache hits", len(pkgs), data.FilesFetched, data.BytesFetched, data.CacheHits))
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// prefetch resolves the packages of each per-arch config, downloading their
+// indexes and the packages themselves through rt.
+func (d *CachePrefetchDataSource) prefetch(ctx context.Context, configs []map[string]apkotypes.ImageConfiguration, rt http.RoundTripper) ([]PrefetchedPackageModel, error) {
+	client := &http.Client{Transport: rt}
+
+	var mu sync.Mutex
+	pkgs := map[string]PrefetchedPackageModel{}
+
+	var errg errgroup.Group
+	errg.SetLimit(prefetchConcurrency)
+	for _, byArch := range configs {
+		for key, ic := range byArch {
+			if key == "index" {
+				continue
+			}
+			arch := apkotypes.ParseArchitecture(key)
+
+			errg.Go(func() error {
+				_, ic2, err := fromImageData(ctx, ic, d.popts)
+				if err != nil {
+					return fmt.Errorf("failed to convert image data to config %q: %w", arch, err)
+				}
+				bc, err := build.New(ctx, tarfs.New(),
+					build.WithImageConfiguration(*ic2),
+					build.WithArch(arch),
+					build.WithExtraKeys(d.popts.keyring),
+					build.WithExtraBuildRepos(d.popts.buildRespositories),
+					build.WithExtraRepos(d.popts.repositories),
+					build.WithSizeLimits(toSizeLimits(d.popts.sizeLimits)),
+					build.WithoutDiskCache(),
+					build.WithTransport(rt),
+				)
+				if err != nil {
+					return fmt.Errorf("failed to start apko build: %w", err)
+				}
+				toInstall, _, err := bc.BuildPackageList(ctx)
+				if err != nil {
+					return fmt.Errorf("resolving packages for %q: %w", arch, err)
+				}
+
+				for _, rp := range toInstall {
+					u := rp.URL()
+					if !remoteURL(u) {
+						// Packages in local repositories are already available offline.
+						continue
+					}
+					mu.Lock()
+					_, seen := pkgs[u]
+					if !seen {
+						pkgs[u] = PrefetchedPackageModel{}
+					}
+					mu.Unlock()
+					if seen {
+						continue
+					}
+
+					digest, size, err := fetchDigest(ctx, client, u)
+					if err != nil {
+						return fmt.Errorf("fetching %s: %w", u, err)
+					}
+					mu.Lock()
+					pkgs[u] = PrefetchedPackageModel{
+						Arch:    arch.ToAPK(),
+						Name:    rp.Name,
+						Version: rp.Version,
+						URL:     u,
+						SHA256:  digest,
+						Size:    size,
+					}
+					mu.Unlock()
+				}
+				return nil
+			})
+		}
+	}
+	if err := errg.Wait(); err != nil {
+		return nil, err
+	}
+
+	out := make([]PrefetchedPackageModel, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		out = append(out, pkg)
+	}
+	slices.SortFunc(out, func(a, b PrefetchedPackageModel) int {
+		return cmp.Or(cmp.Compare(a.Arch, b.Arch), cmp.Compare(a.Name, b.Name), cmp.Compare(a.Version, b.Version), cmp.Compare(a.URL, b.URL))
+	})
+	return out, nil
+}
+
+// fetchDigest downloads u, returning the hex SHA256 and size of its contents.
+func fetchDigest(ctx context.Context, client *http.Client, u string) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// fetchStats counts how the GET requests through a cacheTransport were
+// served.
+type fetchStats struct {
+	hits, misses, bytes atomic.Int64
+}
+
+func (s *fetchStats) hit(req *http.Request) {
+	if s == nil || req.Method != http.MethodGet {
+		return
+	}
+	s.hits.Add(1)
+}
+
+func (s *fetchStats) fetched(size int64) {
+	if s == nil {
+		return
+	}
+	s.misses.Add(1)
+	s.bytes.Add(size)
+}
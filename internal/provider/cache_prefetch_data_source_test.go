@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestAccDataSourceCachePrefetch(t *testing.T) {
+	cacheDir := t.TempDir()
+	config := fmt.Sprintf(`
+provider "apko" {
+  cache_dir = %q
+}
+
+data "apko_config" "this" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+EOF
+}
+
+data "apko_cache_prefetch" "this" {
+  configs = [data.apko_config.this.configs]
+}
+`, cacheDir)
+
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories: []string{"https://packages.wolfi.dev/os"},
+				keyring:      []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:        []string{"x86_64", "aarch64"},
+			}),
+		},
+		Steps: []resource.TestStep{{
+			Config: config,
+			Check: resource.ComposeAggregateTestCheckFunc(
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.#", "2"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.0.arch", "aarch64"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.0.name", "ca-certificates-bundle"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.0.version", "20250911-r0"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.0.url", "https://packages.wolfi.dev/os/aarch64/ca-certificates-bundle-20250911-r0.apk"),
+				resource.TestCheckResourceAttrSet("data.apko_cache_prefetch.this", "packages.0.sha256"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.1.arch", "x86_64"),
+				resource.TestCheckResourceAttrSet("data.apko_cache_prefetch.this", "bytes_fetched"),
+			),
+		}, {
+			// Everything is in the cache now, so the packages are served
+			// from it.
+			Config: config,
+			Check: resource.ComposeAggregateTestCheckFunc(
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "packages.#", "2"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "files_fetched", "0"),
+				resource.TestCheckResourceAttr("data.apko_cache_prefetch.this", "bytes_fetched", "0"),
+			),
+		}},
+	})
+}
+
+func TestFetchStats(t *testing.T) {
+	repo := &testRepo{files: map[string]string{"/os/x86_64/foo-1.0-r0.apk": "foo"}}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &fetchStats{}
+	rt := &cacheTransport{cache: c, inner: http.DefaultTransport, stats: stats}
+	for range 3 {
+		testGet(t, rt, http.MethodGet, srv.URL+"/os/x86_64/foo-1.0-r0.apk")
+	}
+	testGet(t, rt, http.MethodGet, srv.URL+"/os/x86_64/missing.apk")
+
+	if got, want := stats.misses.Load(), int64(1); got != want {
+		t.Errorf("misses = %d, want %d", got, want)
+	}
+	if got, want := stats.bytes.Load(), int64(len("foo")); got != want {
+		t.Errorf("bytes = %d, want %d", got, want)
+	}
+	if got, want := stats.hits.Load(), int64(2); got != want {
+		t.Errorf("hits = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// newLimit returns a semaphore of n slots, or nil, meaning no limit, if n
+// isn't set.
+func newLimit(n *int64) *semaphore.Weighted {
+	if n == nil {
+		return nil
+	}
+	return semaphore.NewWeighted(*n)
+}
+
+// acquireBuild waits for one of the max_concurrent_builds slots, which are
+// shared by every resource of the provider. Calling the returned function
+// releases it.
+func (p ProviderOpts) acquireBuild(ctx context.Context) (func(), error) {
+	if p.builds == nil {
+		return func() {}, nil
+	}
+	if err := p.builds.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { p.builds.Release(1) }, nil
+}
+
+// limitTransport bounds how many requests are in flight at once, holding a
+// slot of sem until the response body has been read or closed.
+type limitTransport struct {
+	sem   *semaphore.Weighted
+	inner http.RoundTripper
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.sem.Acquire(req.Context(), 1); err != nil {
+		return nil, err
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		t.sem.Release(1)
+		return nil, err
+	}
+	if req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		t.sem.Release(1)
+		return resp, nil
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { t.sem.Release(1) }}
+	return resp, nil
+}
+
+// releasingBody calls release once, when it is fully read or closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitTransport(t *testing.T) {
+	var inFlight, peak atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte("package"))
+	}))
+	defer srv.Close()
+
+	limit := int64(2)
+	popts := ProviderOpts{downloads: newLimit(&limit)}
+	client := &http.Client{Transport: popts.fetchTransport()}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("%d requests were in flight at once, wanted at most %d", got, limit)
+	}
+	// Every slot has been released.
+	if !popts.downloads.TryAcquire(limit) {
+		t.Error("slots were not released")
+	}
+}
+
+func TestAcquireBuild(t *testing.T) {
+	ctx := context.Background()
+
+	// No limit.
+	var popts ProviderOpts
+	for range 3 {
+		if _, err := popts.acquireBuild(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limit := int64(1)
+	popts = ProviderOpts{builds: newLimit(&limit)}
+	release, err := popts.acquireBuild(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second build waits for the first.
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := popts.acquireBuild(ctx2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for a slot, got %v", err)
+	}
+
+	release()
+	release, err = popts.acquireBuild(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
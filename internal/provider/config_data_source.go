@@ -6,9 +6,13 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
+	"chainguard.dev/apko/pkg/apk/apk"
 	"chainguard.dev/apko/pkg/build"
 	apkotypes "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/sbom/generator/spdx"
@@ -16,6 +20,7 @@ import (
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
 	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
@@ -158,6 +163,15 @@ func (d *ConfigDataSource) Read(ctx context.Context, req datasource.ReadRequest,
 		return
 	}
 
+	if err := d.popts.checkEmbeddedCredentials(ic); err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("config_contents"), "Credentials in repository URLs", err.Error())
+		return
+	}
+	// The provider's repository_auth covers every host with embedded
+	// credentials, so drop them before the config is written out or
+	// included in errors.
+	stripCredentials(&ic)
+
 	tflog.Trace(ctx, fmt.Sprintf("got repos: %v", d.popts.repositories))
 	tflog.Trace(ctx, fmt.Sprintf("got build repos: %v", d.popts.buildRespositories))
 	tflog.Trace(ctx, fmt.Sprintf("got keyring: %v", d.popts.keyring))
@@ -228,6 +242,7 @@ func (d *ConfigDataSource) Read(ctx context.Context, req datasource.ReadRequest,
 	cfgMap := make(map[string]attr.Value)
 
 	for arch, ic := range pls {
+		stripCredentials(ic)
 		ov, diags := generateValue(*ic)
 		resp.Diagnostics = append(resp.Diagnostics, diags...)
 		if diags.HasError() {
@@ -309,13 +324,21 @@ func (d *ConfigDataSource) resolvePackageList(ctx context.Context, ic apkotypes.
 		return nil, diag.Diagnostics{diag.NewErrorDiagnostic("Unable to parse apko config", err.Error())}
 	}
 
-	pls, missingByArch, err := build.LockImageConfiguration(ctx, *ic2,
-		build.WithCache("", d.popts.planOffline, d.popts.cache),
+	opts := []build.Option{
 		build.WithSBOMGenerators(spdx.New()),
 		build.WithExtraKeys(d.popts.keyring),
 		build.WithExtraBuildRepos(d.popts.buildRespositories),
-		build.WithExtraRepos(d.popts.repositories))
+		build.WithExtraRepos(d.popts.repositories),
+	}
+	if err := d.popts.checkOffline(ic2, ic2.Archs, false); err != nil {
+		return nil, diag.Diagnostics{diag.NewErrorDiagnostic("computing package locks", err.Error())}
+	}
+	missing := &missingFiles{}
+	opts = append(opts, d.popts.cacheOptions(d.popts.planOffline, missing)...)
+	pls, missingByArch, resolved, err := build.LockImageConfigurationWithPackages(ctx, *ic2, opts...)
 	if err != nil {
+		err = missing.wrap(err)
+
 		// These are a nightmare to debug, so we're going to try to include the apko config in the error.
 		b, merr := json.MarshalIndent(ic, "", "  ")
 		if merr != nil {
@@ -337,5 +360,18 @@ func (d *ConfigDataSource) resolvePackageList(ctx context.Context, ic apkotypes.
 		))
 	}
 
+	for _, arch := range slices.SortedFunc(maps.Keys(resolved), func(a, b apkotypes.Architecture) int { return strings.Compare(a.ToAPK(), b.ToAPK()) }) {
+		pkgs := make([]*apk.Package, 0, len(resolved[arch]))
+		for _, pkg := range resolved[arch] {
+			pkgs = append(pkgs, pkg.Package)
+		}
+		if v := d.popts.packagePolicy.violations(ic2.Contents.Packages, pkgs); len(v) != 0 {
+			diagnostics = append(diagnostics, diag.NewErrorDiagnostic(
+				fmt.Sprintf("package_policy violated for %s", arch.ToAPK()),
+				strings.Join(v, "\n"),
+			))
+		}
+	}
+
 	return pls, diagnostics
 }
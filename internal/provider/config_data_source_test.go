@@ -1,11 +1,22 @@
 package provider
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
 )
 
@@ -238,3 +249,116 @@ EOF
 		}},
 	})
 }
+
+func TestAccDataSourceConfig_PackagePolicy(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories: []string{"https://packages.wolfi.dev/os"},
+				keyring:      []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:        []string{"x86_64"},
+			}),
+		},
+		Steps: []resource.TestStep{{
+			Config: `
+provider "apko" {
+  package_policy = {
+    deny     = ["ca-certificates-*"]
+    required = ["wolfi-baselayout"]
+  }
+}
+
+data "apko_config" "this" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle
+EOF
+}`,
+			ExpectError: regexp.MustCompile(`(?s)ca-certificates-bundle=\S+ is denied by "ca-certificates-\*", which was\s+requested directly.*wolfi-baselayout is required`),
+		}, {
+			Config: `
+provider "apko" {
+  package_policy = {
+    deny = ["busybox["]
+  }
+}
+
+data "apko_config" "this" {
+  config_contents = "{}"
+}`,
+			ExpectError: regexp.MustCompile("Invalid glob pattern"),
+		}},
+	})
+}
+
+// TestDataSourceConfig_StripsCredentials tests that credentials embedded in the
+// config for hosts with repository_auth are neither written to
+// TF_APKO_OUT_DIR nor included in errors.
+func TestDataSourceConfig_StripsCredentials(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	out := t.TempDir()
+	t.Setenv("TF_APKO_OUT_DIR", out)
+
+	ac, err := newAPKCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &ConfigDataSource{popts: ProviderOpts{
+		apkCache:       ac,
+		repositoryAuth: map[string]repoCredential{host: {username: "alice", password: "s3cret"}},
+	}}
+	var sresp datasource.SchemaResponse
+	d.Schema(ctx, datasource.SchemaRequest{}, &sresp)
+	state := tfsdk.State{Schema: sresp.Schema, Raw: tftypes.NewValue(sresp.Schema.Type().TerraformType(ctx), nil)}
+	if diags := state.Set(ctx, &ConfigDataSourceModel{
+		ConfigContents: types.StringValue(`
+contents:
+  repositories:
+    - http://alice:s3cret@` + host + `/os
+  packages:
+    - wolfi-baselayout
+archs:
+  - x86_64
+`),
+		Config:  types.ObjectNull(imageConfigurationSchema.AttrTypes),
+		Configs: types.MapNull(sresp.Schema.GetAttributes()["configs"].GetType().(types.MapType).ElemType),
+	}); diags.HasError() {
+		t.Fatalf("Set() = %v", diags.Errors())
+	}
+
+	resp := datasource.ReadResponse{State: state}
+	d.Read(ctx, datasource.ReadRequest{Config: tfsdk.Config{Schema: sresp.Schema, Raw: state.Raw}}, &resp)
+	if !resp.Diagnostics.HasError() {
+		t.Fatal("Read() succeeded, wanted it to fail to resolve packages")
+	}
+	for _, d := range resp.Diagnostics {
+		if strings.Contains(d.Summary()+d.Detail(), "s3cret") {
+			t.Errorf("diagnostic %q contains the password: %s", d.Summary(), d.Detail())
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(out, "*.apko.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no config was written to TF_APKO_OUT_DIR")
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "s3cret") {
+			t.Errorf("%s contains the password:\n%s", f, b)
+		}
+		if !strings.Contains(string(b), "http://"+host+"/os") {
+			t.Errorf("%s doesn't contain the stripped repository:\n%s", f, b)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+)
+
+// parseSourceDateEpoch parses a source date epoch given either as an RFC3339
+// timestamp or as a number of seconds since the unix epoch.
+func parseSourceDateEpoch(val string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a number of seconds since the unix epoch nor an RFC3339 timestamp", val)
+	}
+	return t.UTC(), nil
+}
+
+type sourceDateEpochValidator struct{}
+
+var _ validator.String = sourceDateEpochValidator{}
+
+func (v sourceDateEpochValidator) Description(context.Context) string {
+	return "value must be an RFC3339 timestamp or a number of seconds since the unix epoch"
+}
+func (v sourceDateEpochValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v sourceDateEpochValidator) ValidateString(_ context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+	if _, err := parseSourceDateEpoch(req.ConfigValue.ValueString()); err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid source date epoch", err.Error())
+	}
+}
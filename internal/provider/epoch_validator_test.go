@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSourceDateEpoch(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{{
+		in:   "0",
+		want: time.Unix(0, 0).UTC(),
+	}, {
+		in:   "1704067200",
+		want: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, {
+		in:   "2024-01-01T00:00:00Z",
+		want: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, {
+		in:   "2024-01-01T02:00:00+02:00",
+		want: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, {
+		in:      "2024-01-01",
+		wantErr: true,
+	}, {
+		in:      "yesterday",
+		wantErr: true,
+	}} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseSourceDateEpoch(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseSourceDateEpoch(%q) = %v, wanted error", tc.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSourceDateEpoch(%q) = %v", tc.in, err)
+			}
+			if !got.Equal(tc.want) || got.Location() != time.UTC {
+				t.Errorf("parseSourceDateEpoch(%q) = %v, wanted %v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package provider
+
+// lockFile is a no-op where flock isn't available, leaving the cache to rely
+// on atomic renames alone.
+func lockFile(string) (func(), error) { return func() {}, nil }
+
+func tryLockFile(string) (func(), bool, error) { return func() {}, true, nil }
@@ -0,0 +1,529 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &ImageInspectDataSource{}
+
+func NewImageInspectDataSource() datasource.DataSource {
+	return &ImageInspectDataSource{}
+}
+
+// ImageInspectDataSource defines the data source implementation.
+type ImageInspectDataSource struct {
+	popts ProviderOpts
+}
+
+// ImageInspectDataSourceModel describes the data source data model.
+type ImageInspectDataSourceModel struct {
+	Id       types.String `tfsdk:"id"`
+	ImageRef types.String `tfsdk:"image_ref"`
+
+	Digest      string                         `tfsdk:"digest"`
+	Archs       []string                       `tfsdk:"archs"`
+	Annotations map[string]string              `tfsdk:"annotations"`
+	Images      map[string]InspectedImageModel `tfsdk:"images"`
+}
+
+// InspectedImageModel describes the image of one architecture.
+type InspectedImageModel struct {
+	Digest       string                `tfsdk:"digest"`
+	Entrypoint   []string              `tfsdk:"entrypoint"`
+	Cmd          []string              `tfsdk:"cmd"`
+	User         string                `tfsdk:"user"`
+	WorkingDir   string                `tfsdk:"working_dir"`
+	Env          []string              `tfsdk:"env"`
+	Labels       map[string]string     `tfsdk:"labels"`
+	Annotations  map[string]string     `tfsdk:"annotations"`
+	Layers       []InspectedLayerModel `tfsdk:"layers"`
+	Size         int64                 `tfsdk:"size"`
+	Packages     map[string]string     `tfsdk:"packages"`
+	PackagesFrom string                `tfsdk:"packages_from"`
+}
+
+// InspectedLayerModel describes a layer of an image.
+type InspectedLayerModel struct {
+	Digest    string `tfsdk:"digest"`
+	MediaType string `tfsdk:"media_type"`
+	Size      int64  `tfsdk:"size"`
+}
+
+const (
+	packagesFromSBOM        = "sbom"
+	packagesFromInstalledDB = "installed_database"
+)
+
+// sbomArtifactTypes are the artifact types of referrers that may hold an SPDX
+// SBOM of an image: the SBOM itself, or an in-toto attestation of it in a DSSE
+// envelope, on its own or in a sigstore bundle.
+var sbomArtifactTypes = []string{
+	"application/spdx+json",
+	"text/spdx+json",
+	"application/vnd.dsse.envelope.v1+json",
+	"application/vnd.in-toto+json",
+}
+
+// sigstoreBundleArtifactType prefixes the versioned artifact types of sigstore
+// bundles.
+const sigstoreBundleArtifactType = "application/vnd.dev.sigstore.bundle"
+
+const (
+	inTotoPayloadType = "application/vnd.in-toto+json"
+	spdxPredicateType = "https://spdx.dev/Document"
+)
+
+func (d *ImageInspectDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_image_inspect"
+}
+
+func (d *ImageInspectDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "This reads back what a published image contains, without pulling it: its architectures, configuration, layers and installed packages. The packages are read from an SBOM attached to the image when there is one, and otherwise from the layers of the image, which are downloaded but not stored.",
+		Attributes: map[string]schema.Attribute{
+			"image_ref": schema.StringAttribute{
+				MarkdownDescription: "The image or index to inspect, by tag or digest.",
+				Required:            true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "The fully-qualified digest of the image or index.",
+				Computed:            true,
+			},
+			"digest": schema.StringAttribute{
+				MarkdownDescription: "The digest of the image or index.",
+				Computed:            true,
+			},
+			"archs": schema.ListAttribute{
+				MarkdownDescription: "The APK architectures of the image, sorted.",
+				Computed:            true,
+				ElementType:         basetypes.StringType{},
+			},
+			"annotations": schema.MapAttribute{
+				MarkdownDescription: "The annotations of the index, or of the image if it isn't an index.",
+				Computed:            true,
+				ElementType:         basetypes.StringType{},
+			},
+			"images": schema.MapNestedAttribute{
+				MarkdownDescription: "A map from the APK architecture to the image for that architecture.",
+				Computed:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"digest": schema.StringAttribute{
+							MarkdownDescription: "The digest of the image.",
+							Computed:            true,
+						},
+						"entrypoint": schema.ListAttribute{
+							MarkdownDescription: "The entrypoint of the image.",
+							Computed:            true,
+							ElementType:         basetypes.StringType{},
+						},
+						"cmd": schema.ListAttribute{
+							MarkdownDescription: "The default arguments of the entrypoint.",
+							Computed:            true,
+							ElementType:         basetypes.StringType{},
+						},
+						"user": schema.StringAttribute{
+							MarkdownDescription: "The user the image runs as.",
+							Computed:            true,
+						},
+						"working_dir": schema.StringAttribute{
+							MarkdownDescription: "The working directory of the image.",
+							Computed:            true,
+						},
+						"env": schema.ListAttribute{
+							MarkdownDescription: "The environment of the image, as `NAME=value`.",
+							Computed:            true,
+							ElementType:         basetypes.StringType{},
+						},
+						"labels": schema.MapAttribute{
+							MarkdownDescription: "The labels of the image configuration.",
+							Computed:            true,
+							ElementType:         basetypes.StringType{},
+						},
+						"annotations": schema.MapAttribute{
+							MarkdownDescription: "The annotations of the image manifest.",
+							Computed:            true,
+							ElementType:         basetypes.StringType{},
+						},
+						"layers": schema.ListNestedAttribute{
+							MarkdownDescription: "The layers of the image, from the bottom up.",
+							Computed:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"digest": schema.StringAttribute{
+										MarkdownDescription: "The digest of the layer.",
+										Computed:            true,
+									},
+									"media_type": schema.StringAttribute{
+										MarkdownDescription: "The media type of the layer.",
+										Computed:            true,
+									},
+									"size": schema.Int64Attribute{
+										MarkdownDescription: "The compressed size of the layer in bytes.",
+										Computed:            true,
+									},
+								},
+							},
+						},
+						"size": schema.Int64Attribute{
+							MarkdownDescription: "The compressed size of the layers in bytes.",
+							Computed:            true,
+						},
+						"packages": schema.MapAttribute{
+							MarkdownDescription: "A map from the name of each installed package to its version.",
+							Computed:            true,
+							ElementType:         basetypes.StringType{},
+						},
+						"packages_from": schema.StringAttribute{
+							MarkdownDescription: "Where `packages` was read from: `sbom` for an SPDX SBOM attached to the image, as a referrer or as a cosign attestation, either plain or as an in-toto attestation, or `installed_database` for the APK database in the layers of the image. Reading the database downloads every layer of the image, streaming rather than storing them.",
+							Computed:            true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (d *ImageInspectDataSource) Configure(_ context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	popts, ok := req.ProviderData.(*ProviderOpts)
+	if !ok || popts == nil {
+		resp.Diagnostics.AddError("Client Error", "invalid provider data")
+		return
+	}
+	d.popts = *popts
+}
+
+func (d *ImageInspectDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data ImageInspectDataSourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	ref, err := name.ParseReference(data.ImageRef.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error parsing image_ref: %v", err))
+		return
+	}
+	if err := d.popts.inspect(ctx, ref, &data); err != nil {
+		resp.Diagnostics.AddError("Error inspecting "+ref.String(), err.Error())
+		return
+	}
+
+	tflog.Trace(ctx, "read a data source")
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// inspect fills in data with what ref contains.
+func (p ProviderOpts) inspect(ctx context.Context, ref name.Reference, data *ImageInspectDataSourceModel) error {
+	ropts := append(p.ropts, remote.WithContext(ctx))
+	desc, err := remote.Get(ref, ropts...)
+	if err != nil {
+		return err
+	}
+	data.Digest = desc.Digest.String()
+	data.Id = types.StringValue(ref.Context().Digest(data.Digest).String())
+	data.Images = map[string]InspectedImageModel{}
+
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		data.Annotations = m.Annotations
+		cf, err := img.ConfigFile()
+		if err != nil {
+			return err
+		}
+		arch := platformArchitecture(cf.Platform())
+		if data.Images[arch.ToAPK()], err = p.inspectImage(ctx, ref.Context().Digest(data.Digest), img); err != nil {
+			return fmt.Errorf("%s: %w", arch.ToAPK(), err)
+		}
+		data.Archs = []string{arch.ToAPK()}
+		return nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	data.Annotations = im.Annotations
+	for _, m := range im.Manifests {
+		if m.Platform == nil || !m.MediaType.IsImage() {
+			continue
+		}
+		arch := platformArchitecture(m.Platform).ToAPK()
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arch, err)
+		}
+		if data.Images[arch], err = p.inspectImage(ctx, ref.Context().Digest(m.Digest.String()), img); err != nil {
+			return fmt.Errorf("%s: %w", arch, err)
+		}
+		data.Archs = append(data.Archs, arch)
+	}
+	slices.Sort(data.Archs)
+	return nil
+}
+
+// inspectImage describes img, the image dig.
+func (p ProviderOpts) inspectImage(ctx context.Context, dig name.Digest, img v1.Image) (InspectedImageModel, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return InspectedImageModel{}, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return InspectedImageModel{}, err
+	}
+	model := InspectedImageModel{
+		Digest:      dig.DigestStr(),
+		Entrypoint:  cf.Config.Entrypoint,
+		Cmd:         cf.Config.Cmd,
+		User:        cf.Config.User,
+		WorkingDir:  cf.Config.WorkingDir,
+		Env:         cf.Config.Env,
+		Labels:      cf.Config.Labels,
+		Annotations: m.Annotations,
+	}
+	for _, l := range m.Layers {
+		model.Layers = append(model.Layers, InspectedLayerModel{
+			Digest:    l.Digest.String(),
+			MediaType: string(l.MediaType),
+			Size:      l.Size,
+		})
+		model.Size += l.Size
+	}
+
+	model.Packages, model.PackagesFrom, err = p.imagePackageVersions(ctx, dig, img)
+	if err != nil {
+		return InspectedImageModel{}, err
+	}
+	return model, nil
+}
+
+// imagePackageVersions returns the versions of the packages in img, which is
+// dig, by name. They are read from an SBOM attached to the image if there is
+// one, and otherwise from its installed database, which downloads its layers.
+// It also returns which of the two they were read from.
+func (p ProviderOpts) imagePackageVersions(ctx context.Context, dig name.Digest, img v1.Image) (map[string]string, string, error) {
+	pkgs, err := p.sbomPackages(ctx, dig)
+	if err != nil {
+		tflog.Debug(ctx, fmt.Sprintf("unable to read an SBOM of %s, reading its installed packages: %v", dig, err))
+	}
+	if pkgs != nil {
+		return pkgs, packagesFromSBOM, nil
+	}
+	installed, err := installedPackages(img)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading installed packages: %w", err)
+	}
+	pkgs = make(map[string]string, len(installed))
+	for _, pkg := range installed {
+		name, version, _ := strings.Cut(pkg, "=")
+		pkgs[name] = version
+	}
+	return pkgs, packagesFromInstalledDB, nil
+}
+
+// sbomPackages reads the APK packages from an SPDX SBOM attached to dig,
+// returning nil if there is none. SBOMs are looked for among the referrers of
+// dig, then in the attestations that cosign attaches to it by tag.
+func (p ProviderOpts) sbomPackages(ctx context.Context, dig name.Digest) (map[string]string, error) {
+	ropts := append(p.ropts, remote.WithContext(ctx))
+
+	var errs []error
+	pkgs, err := referrerSBOMPackages(dig, ropts)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading referrers: %w", err))
+	} else if pkgs != nil {
+		return pkgs, nil
+	}
+
+	att := dig.Context().Tag(strings.Replace(dig.DigestStr(), ":", "-", 1) + ".att")
+	img, err := remote.Image(att, ropts...)
+	if terr, ok := errors.AsType[*transport.Error](err); ok && terr.StatusCode == http.StatusNotFound {
+		return nil, errors.Join(errs...)
+	} else if err != nil {
+		return nil, errors.Join(append(errs, fmt.Errorf("reading %s: %w", att, err))...)
+	}
+	pkgs, err = imageSBOMPackages(img)
+	if err != nil {
+		return nil, errors.Join(append(errs, fmt.Errorf("reading %s: %w", att, err))...)
+	}
+	return pkgs, errors.Join(errs...)
+}
+
+// referrerSBOMPackages reads the APK packages from the first SPDX SBOM among
+// the referrers of dig.
+func referrerSBOMPackages(dig name.Digest, ropts []remote.Option) (map[string]string, error) {
+	referrers, err := remote.Referrers(dig, ropts...)
+	if err != nil {
+		return nil, err
+	}
+	im, err := referrers.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range im.Manifests {
+		if !slices.Contains(sbomArtifactTypes, desc.ArtifactType) && !strings.HasPrefix(desc.ArtifactType, sigstoreBundleArtifactType) {
+			continue
+		}
+		// Skip the bundles of other attestations, e.g. provenance.
+		if pt, ok := desc.Annotations["dev.sigstore.bundle.predicateType"]; ok && !strings.HasPrefix(pt, spdxPredicateType) {
+			continue
+		}
+		img, err := remote.Image(dig.Context().Digest(desc.Digest.String()), ropts...)
+		if err != nil {
+			return nil, err
+		}
+		pkgs, err := imageSBOMPackages(img)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", desc.Digest, err)
+		}
+		if pkgs != nil {
+			return pkgs, nil
+		}
+	}
+	return nil, nil
+}
+
+// imageSBOMPackages reads the APK packages from the first of the layers of
+// img that is an SPDX SBOM, or an attestation of one.
+func imageSBOMPackages(img v1.Image) (map[string]string, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range m.Layers {
+		// cosign records the predicate type of each attestation.
+		if pt, ok := desc.Annotations["predicateType"]; ok && !strings.HasPrefix(pt, spdxPredicateType) {
+			continue
+		}
+		l, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		pkgs, err := parseSBOMPackages(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing SBOM %s: %w", desc.Digest, err)
+		}
+		if len(pkgs) != 0 {
+			return pkgs, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseSBOMPackages returns the version of each APK package of an SPDX SBOM,
+// which may be wrapped in an in-toto statement, a DSSE envelope and a sigstore
+// bundle. It returns nil for attestations of anything else.
+func parseSBOMPackages(b []byte) (map[string]string, error) {
+	var doc struct {
+		// A sigstore bundle.
+		DSSEEnvelope json.RawMessage `json:"dsseEnvelope"`
+		// A DSSE envelope, whose payload is base64 encoded.
+		PayloadType string `json:"payloadType"`
+		Payload     []byte `json:"payload"`
+		// An in-toto statement.
+		PredicateType string          `json:"predicateType"`
+		Predicate     json.RawMessage `json:"predicate"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(doc.DSSEEnvelope) != 0:
+		return parseSBOMPackages(doc.DSSEEnvelope)
+	case doc.PayloadType != "":
+		if doc.PayloadType != inTotoPayloadType {
+			return nil, nil
+		}
+		return parseSBOMPackages(doc.Payload)
+	case doc.PredicateType != "":
+		if !strings.HasPrefix(doc.PredicateType, spdxPredicateType) {
+			return nil, nil
+		}
+		predicate := doc.Predicate
+		// Some attesters embed the document as a string.
+		var s string
+		if json.Unmarshal(predicate, &s) == nil {
+			predicate = []byte(s)
+		}
+		return parseSPDXPackages(bytes.NewReader(predicate))
+	default:
+		return parseSPDXPackages(bytes.NewReader(b))
+	}
+}
+
+// parseSPDXPackages returns the version of each APK package of an SPDX SBOM,
+// which are those with an apk package URL.
+func parseSPDXPackages(r io.Reader) (map[string]string, error) {
+	var doc struct {
+		Packages []struct {
+			Name         string `json:"name"`
+			VersionInfo  string `json:"versionInfo"`
+			ExternalRefs []struct {
+				ReferenceType    string `json:"referenceType"`
+				ReferenceLocator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	pkgs := map[string]string{}
+	for _, pkg := range doc.Packages {
+		for _, ref := range pkg.ExternalRefs {
+			if ref.ReferenceType == "purl" && strings.HasPrefix(ref.ReferenceLocator, "pkg:apk/") {
+				pkgs[pkg.Name] = pkg.VersionInfo
+				break
+			}
+		}
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,332 @@
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const testSPDX = `{
+  "spdxVersion": "SPDX-2.3",
+  "packages": [
+    {"name": "sbom", "versionInfo": "", "externalRefs": [{"referenceType": "purl", "referenceLocator": "pkg:oci/test@sha256:abc"}]},
+    {"name": "foo", "versionInfo": "1.1-r0", "externalRefs": [{"referenceType": "purl", "referenceLocator": "pkg:apk/wolfi/foo@1.1-r0?arch=x86_64"}]}
+  ]
+}`
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer srv.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := tarLayer(t, []tar.Header{
+		{Name: "usr/lib/apk/db/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: installedDB, Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{installedDB: testInstalledDB})
+	base, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := func(arch string) v1.Image {
+		img, err := mutate.Config(base, v1.Config{
+			Entrypoint: []string{"/usr/bin/foo"},
+			Cmd:        []string{"--help"},
+			User:       "65532",
+			WorkingDir: "/home/nonroot",
+			Env:        []string{"PATH=/usr/bin"},
+			Labels:     map[string]string{"arch": arch},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img = mutate.Annotations(img, map[string]string{"org.opencontainers.image.title": arch}).(v1.Image)
+		img, err = mutate.ConfigFile(img, func() *v1.ConfigFile {
+			cf, err := img.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf = cf.DeepCopy()
+			cf.OS, cf.Architecture = "linux", arch
+			return cf
+		}())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	amd64, arm64 := image("amd64"), image("arm64")
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	idx = mutate.Annotations(idx, map[string]string{"org.opencontainers.image.created": "2025-01-01T00:00:00Z"}).(v1.ImageIndex)
+	tag := repo.Tag("latest")
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the amd64 image has an SBOM attached.
+	amd64Desc, err := partial.Descriptor(amd64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64Desc.Platform = nil
+	sbom, err := mutate.AppendLayers(empty.Image, static.NewLayer([]byte(testSPDX), "application/spdx+json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom = mutate.ConfigMediaType(mutate.MediaType(sbom, ggcrtypes.OCIManifestSchema1), "application/spdx+json")
+	sbom = mutate.Subject(sbom, *amd64Desc).(v1.Image)
+	sbomDigest, err := sbom.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Digest(sbomDigest.String()), sbom); err != nil {
+		t.Fatal(err)
+	}
+
+	var popts ProviderOpts
+	var data ImageInspectDataSourceModel
+	if err := popts.inspect(ctx, tag, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Digest != h.String() || data.Id.ValueString() != repo.Digest(h.String()).String() {
+		t.Errorf("digest, id = %s, %s, wanted %s", data.Digest, data.Id.ValueString(), h)
+	}
+	if want := []string{"aarch64", "x86_64"}; !reflect.DeepEqual(data.Archs, want) {
+		t.Errorf("archs = %v, wanted %v", data.Archs, want)
+	}
+	if got := data.Annotations["org.opencontainers.image.created"]; got != "2025-01-01T00:00:00Z" {
+		t.Errorf("annotations = %v", data.Annotations)
+	}
+
+	for arch, want := range map[string]struct {
+		img      v1.Image
+		label    string
+		packages map[string]string
+		from     string
+	}{
+		"x86_64":  {amd64, "amd64", map[string]string{"foo": "1.1-r0"}, packagesFromSBOM},
+		"aarch64": {arm64, "arm64", map[string]string{"foo": "1.0-r0", "bar": "2.0-r0"}, packagesFromInstalledDB},
+	} {
+		got, ok := data.Images[arch]
+		if !ok {
+			t.Fatalf("no %s image in %v", arch, data.Images)
+		}
+		d, err := want.img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Digest != d.String() {
+			t.Errorf("%s digest = %s, wanted %s", arch, got.Digest, d)
+		}
+		if !reflect.DeepEqual(got.Entrypoint, []string{"/usr/bin/foo"}) || !reflect.DeepEqual(got.Cmd, []string{"--help"}) ||
+			got.User != "65532" || got.WorkingDir != "/home/nonroot" || !reflect.DeepEqual(got.Env, []string{"PATH=/usr/bin"}) {
+			t.Errorf("%s config = %+v", arch, got)
+		}
+		if got.Labels["arch"] != want.label || got.Annotations["org.opencontainers.image.title"] != want.label {
+			t.Errorf("%s labels, annotations = %v, %v", arch, got.Labels, got.Annotations)
+		}
+		size, err := layer.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Layers) != 1 || got.Layers[0].Size != size || got.Size != size {
+			t.Errorf("%s layers = %+v, size = %d, wanted one layer of %d", arch, got.Layers, got.Size, size)
+		}
+		if !reflect.DeepEqual(got.Packages, want.packages) || got.PackagesFrom != want.from {
+			t.Errorf("%s packages = %v from %s, wanted %v from %s", arch, got.Packages, got.PackagesFrom, want.packages, want.from)
+		}
+	}
+}
+
+func TestParseSPDXPackages(t *testing.T) {
+	got, err := parseSPDXPackages(strings.NewReader(testSPDX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"foo": "1.1-r0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSPDXPackages() = %v, wanted %v", got, want)
+	}
+}
+
+// testAttestation wraps an SPDX SBOM in an in-toto statement of the given
+// predicate type, in a DSSE envelope.
+func testAttestation(t *testing.T, predicateType string, predicate any) string {
+	t.Helper()
+	statement, err := json.Marshal(map[string]any{
+		"_type":         "https://in-toto.io/Statement/v0.1",
+		"predicateType": predicateType,
+		"subject":       []any{},
+		"predicate":     predicate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := json.Marshal(map[string]any{
+		"payloadType": "application/vnd.in-toto+json",
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+		"signatures":  []any{map[string]string{"sig": "c2ln"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(envelope)
+}
+
+func TestParseSBOMPackages(t *testing.T) {
+	var spdx map[string]any
+	if err := json.Unmarshal([]byte(testSPDX), &spdx); err != nil {
+		t.Fatal(err)
+	}
+	envelope := testAttestation(t, "https://spdx.dev/Document", spdx)
+	want := map[string]string{"foo": "1.1-r0"}
+
+	for _, tc := range []struct {
+		name string
+		doc  string
+		want map[string]string
+	}{
+		{"spdx", testSPDX, want},
+		{"dsse", envelope, want},
+		{"string predicate", testAttestation(t, "https://spdx.dev/Document/v2.3", testSPDX), want},
+		{"sigstore bundle", `{"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json", "dsseEnvelope": ` + envelope + `}`, want},
+		{"provenance", testAttestation(t, "https://slsa.dev/provenance/v1", map[string]any{}), nil},
+		{"other payload", `{"payloadType": "text/plain", "payload": "aGk="}`, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSBOMPackages([]byte(tc.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseSBOMPackages() = %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSBOMPackagesAttestations(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(registry.New(registry.WithReferrersSupport(true)))
+	defer srv.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spdx map[string]any
+	if err := json.Unmarshal([]byte(testSPDX), &spdx); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"foo": "1.1-r0"}
+
+	push := func(img v1.Image) (name.Digest, *v1.Descriptor) {
+		t.Helper()
+		d, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dig := repo.Digest(d.String())
+		if err := remote.Write(dig, img); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := partial.Descriptor(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dig, desc
+	}
+	attestations := func(layers ...mutate.Addendum) v1.Image {
+		t.Helper()
+		img, err := mutate.Append(mutate.MediaType(empty.Image, ggcrtypes.OCIManifestSchema1), layers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	attestation := func(predicateType string, predicate any) mutate.Addendum {
+		return mutate.Addendum{
+			Layer:       static.NewLayer([]byte(testAttestation(t, predicateType, predicate)), "application/vnd.dsse.envelope.v1+json"),
+			Annotations: map[string]string{"predicateType": predicateType},
+		}
+	}
+
+	// cosign attaches attestations to an image under a tag named for its
+	// digest.
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, _ := push(img)
+	att := attestations(
+		attestation("https://slsa.dev/provenance/v1", map[string]any{}),
+		attestation("https://spdx.dev/Document", spdx),
+	)
+	if err := remote.Write(repo.Tag(strings.Replace(dig.DigestStr(), ":", "-", 1)+".att"), att); err != nil {
+		t.Fatal(err)
+	}
+	var popts ProviderOpts
+	if got, err := popts.sbomPackages(ctx, dig); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("sbomPackages(cosign attestation) = %v, %v, wanted %v", got, err, want)
+	}
+
+	// And newer versions attach sigstore bundles as referrers.
+	img, err = random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, desc := push(img)
+	desc.Platform = nil
+	for _, predicateType := range []string{"https://slsa.dev/provenance/v1", "https://spdx.dev/Document"} {
+		var predicate any = map[string]any{}
+		if predicateType == "https://spdx.dev/Document" {
+			predicate = spdx
+		}
+		bundle := `{"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json", "dsseEnvelope": ` + testAttestation(t, predicateType, predicate) + `}`
+		ref, err := mutate.AppendLayers(mutate.MediaType(empty.Image, ggcrtypes.OCIManifestSchema1), static.NewLayer([]byte(bundle), "application/vnd.dev.sigstore.bundle.v0.3+json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref = mutate.ConfigMediaType(ref, "application/vnd.dev.sigstore.bundle.v0.3+json")
+		ref = mutate.Annotations(ref, map[string]string{"dev.sigstore.bundle.predicateType": predicateType}).(v1.Image)
+		push(mutate.Subject(ref, *desc).(v1.Image))
+	}
+	if got, err := popts.sbomPackages(ctx, dig); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("sbomPackages(sigstore bundle) = %v, %v, wanted %v", got, err, want)
+	}
+
+	// Without either, there are no packages.
+	img, err = random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, _ = push(img)
+	if got, err := popts.sbomPackages(ctx, dig); err != nil || got != nil {
+		t.Errorf("sbomPackages(no SBOM) = %v, %v, wanted nil", got, err)
+	}
+}
@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"chainguard.dev/apko/pkg/build"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// largestPackages is how many packages a size error lists.
+const largestPackages = 10
+
+const (
+	maxCompressedSizeDescription   = "The largest the compressed layers of the image of any architecture may be, in bytes. The build fails, listing the largest packages by installed size, if an image is larger. Lowering it below the size of an image that was already built fails the plan."
+	maxUncompressedSizeDescription = "The largest the uncompressed layers of the image of any architecture may be, in bytes. The build fails, listing the largest packages by installed size, if an image is larger. Lowering it below the size of an image that was already built fails the plan."
+)
+
+var imageSizesAttribute = schema.MapNestedAttribute{
+	MarkdownDescription: "A map from the architecture to the size of the layers of the image for that architecture.",
+	Computed:            true,
+	NestedObject: schema.NestedAttributeObject{
+		Attributes: map[string]schema.Attribute{
+			"compressed": schema.Int64Attribute{
+				MarkdownDescription: "The compressed size of the layers in bytes.",
+				Computed:            true,
+			},
+			"uncompressed": schema.Int64Attribute{
+				MarkdownDescription: "The uncompressed size of the layers in bytes.",
+				Computed:            true,
+			},
+		},
+	},
+}
+
+var imageSizeSchema = basetypes.ObjectType{
+	AttrTypes: map[string]attr.Type{
+		"compressed":   basetypes.Int64Type{},
+		"uncompressed": basetypes.Int64Type{},
+	},
+}
+
+// imageSize returns the compressed and uncompressed sizes of the layers of
+// img.
+func imageSize(img v1.Image) (int64, int64, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return 0, 0, err
+	}
+	var compressed, uncompressed int64
+	for _, l := range layers {
+		size, err := l.Size()
+		if err != nil {
+			return 0, 0, err
+		}
+		usize, err := partial.UncompressedSize(l)
+		if err != nil {
+			return 0, 0, err
+		}
+		compressed += size
+		uncompressed += usize
+	}
+	return compressed, uncompressed, nil
+}
+
+// checkImageSize measures the image img built by bc, and fails if it is over
+// max_compressed_size or max_uncompressed_size, listing the packages that
+// take up the most space.
+func (b buildOptions) checkImageSize(bc *build.Context, img v1.Image) (int64, int64, error) {
+	compressed, uncompressed, err := imageSize(img)
+	if err != nil {
+		return 0, 0, fmt.Errorf("measuring image: %w", err)
+	}
+
+	over := b.overBudget(compressed, uncompressed)
+	if len(over) == 0 {
+		return compressed, uncompressed, nil
+	}
+
+	msg := fmt.Sprintf("the %s image is %s", bc.Arch().ToAPK(), strings.Join(over, ", and "))
+	pkgs, err := bc.InstalledPackages()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s (unable to list the installed packages: %w)", msg, err)
+	}
+	return 0, 0, fmt.Errorf("%s\n\nThe largest packages by installed size are:\n%s", msg, sizeBreakdown(pkgs))
+}
+
+// overBudget describes how an image of the given sizes exceeds the limits.
+func (b buildOptions) overBudget(compressed, uncompressed int64) []string {
+	var over []string
+	if b.maxCompressedSize != nil && compressed > *b.maxCompressedSize {
+		over = append(over, fmt.Sprintf("%s compressed, over the max_compressed_size of %s", byteSize(compressed), byteSize(*b.maxCompressedSize)))
+	}
+	if b.maxUncompressedSize != nil && uncompressed > *b.maxUncompressedSize {
+		over = append(over, fmt.Sprintf("%s uncompressed, over the max_uncompressed_size of %s", byteSize(uncompressed), byteSize(*b.maxUncompressedSize)))
+	}
+	return over
+}
+
+// sizeBreakdown lists the largest of pkgs by installed size.
+func sizeBreakdown(pkgs []*apk.InstalledPackage) string {
+	pkgs = slices.Clone(pkgs)
+	slices.SortFunc(pkgs, func(a, b *apk.InstalledPackage) int {
+		return cmp.Or(cmp.Compare(b.InstalledSize, a.InstalledSize), strings.Compare(a.Name, b.Name))
+	})
+	var total uint64
+	for _, pkg := range pkgs {
+		total += pkg.InstalledSize
+	}
+
+	var sb strings.Builder
+	for _, pkg := range pkgs[:min(len(pkgs), largestPackages)] {
+		fmt.Fprintf(&sb, "  %-40s %10s\n", pkg.Name+"="+pkg.Version, byteSize(int64(pkg.InstalledSize)))
+	}
+	if rest := len(pkgs) - largestPackages; rest > 0 {
+		fmt.Fprintf(&sb, "  and %d more\n", rest)
+	}
+	fmt.Fprintf(&sb, "  %d packages, %s in total", len(pkgs), byteSize(int64(total)))
+	return sb.String()
+}
+
+// imageSizes returns the sizes of the images of sboms by architecture.
+func imageSizes(sboms map[string]imagesbom) (types.Map, diag.Diagnostics) {
+	sizes := make(map[string]attr.Value, len(sboms))
+	for arch, sb := range sboms {
+		if arch == "index" {
+			continue
+		}
+		v, diags := types.ObjectValue(imageSizeSchema.AttrTypes, map[string]attr.Value{
+			"compressed":   types.Int64Value(sb.compressedSize),
+			"uncompressed": types.Int64Value(sb.uncompressedSize),
+		})
+		if diags.HasError() {
+			return types.Map{}, diags
+		}
+		sizes[arch] = v
+	}
+	return types.MapValue(imageSizeSchema, sizes)
+}
+
+// checkImageSizes checks the recorded sizes of images that are kept against
+// the limits, which may have been lowered since they were built.
+func checkImageSizes(sizes types.Map, maxCompressed, maxUncompressed types.Int64) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if sizes.IsNull() || sizes.IsUnknown() {
+		return diags
+	}
+	for _, arch := range slices.Sorted(maps.Keys(sizes.Elements())) {
+		obj, ok := sizes.Elements()[arch].(types.Object)
+		if !ok {
+			continue
+		}
+		for _, l := range []struct {
+			kind  string
+			limit types.Int64
+		}{{"compressed", maxCompressed}, {"uncompressed", maxUncompressed}} {
+			size, ok := obj.Attributes()[l.kind].(types.Int64)
+			if !ok || l.limit.IsNull() || l.limit.IsUnknown() || size.ValueInt64() <= l.limit.ValueInt64() {
+				continue
+			}
+			diags.AddAttributeError(path.Root("max_"+l.kind+"_size"), "Image over size budget",
+				fmt.Sprintf("The %s image that was already built is %s %s, over the max_%s_size of %s.",
+					arch, byteSize(size.ValueInt64()), l.kind, l.kind, byteSize(l.limit.ValueInt64())))
+		}
+	}
+	return diags
+}
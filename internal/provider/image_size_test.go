@@ -0,0 +1,148 @@
+package provider
+
+import (
+	"archive/tar"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestImageSize(t *testing.T) {
+	a := tarLayer(t, []tar.Header{{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644}}, map[string]string{"a": strings.Repeat("a", 4096)})
+	b := tarLayer(t, []tar.Header{{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644}}, map[string]string{"b": "b"})
+	img, err := mutate.AppendLayers(empty.Image, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wantCompressed, wantUncompressed int64
+	for _, l := range []interface {
+		Size() (int64, error)
+	}{a, b} {
+		size, err := l.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantCompressed += size
+	}
+	// Each layer is a 512 byte header, the contents padded to 512 bytes,
+	// and two 512 byte blocks of zeroes.
+	wantUncompressed = (512 + 4096 + 1024) + (512 + 512 + 1024)
+
+	compressed, uncompressed, err := imageSize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed != wantCompressed || uncompressed != wantUncompressed {
+		t.Errorf("imageSize() = %d, %d, wanted %d, %d", compressed, uncompressed, wantCompressed, wantUncompressed)
+	}
+}
+
+func TestOverBudget(t *testing.T) {
+	limit := func(n int64) *int64 { return &n }
+	for _, tc := range []struct {
+		name                     string
+		bopts                    buildOptions
+		compressed, uncompressed int64
+		want                     []string
+	}{
+		{name: "no limits", compressed: 1 << 30, uncompressed: 1 << 40},
+		{
+			name:       "under",
+			bopts:      buildOptions{maxCompressedSize: limit(100), maxUncompressedSize: limit(200)},
+			compressed: 100, uncompressed: 200,
+		},
+		{
+			name:       "compressed",
+			bopts:      buildOptions{maxCompressedSize: limit(1 << 20)},
+			compressed: 3 << 20, uncompressed: 10 << 20,
+			want: []string{"3.0 MiB compressed, over the max_compressed_size of 1.0 MiB"},
+		},
+		{
+			name:       "both",
+			bopts:      buildOptions{maxCompressedSize: limit(1 << 20), maxUncompressedSize: limit(2 << 20)},
+			compressed: 3 << 20, uncompressed: 10 << 20,
+			want: []string{
+				"3.0 MiB compressed, over the max_compressed_size of 1.0 MiB",
+				"10.0 MiB uncompressed, over the max_uncompressed_size of 2.0 MiB",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.bopts.overBudget(tc.compressed, tc.uncompressed); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("overBudget() = %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSizeBreakdown(t *testing.T) {
+	var pkgs []*apk.InstalledPackage
+	for i := range 12 {
+		pkgs = append(pkgs, &apk.InstalledPackage{Package: apk.Package{
+			Name:          fmt.Sprintf("pkg-%02d", i),
+			Version:       "1.0-r0",
+			InstalledSize: uint64(i) << 20,
+		}})
+	}
+	got := sizeBreakdown(pkgs)
+	lines := strings.Split(got, "\n")
+	if len(lines) != 12 {
+		t.Fatalf("sizeBreakdown() = %q, wanted 10 packages, the rest and the total", got)
+	}
+	if !strings.Contains(lines[0], "pkg-11=1.0-r0") || !strings.Contains(lines[0], "11.0 MiB") {
+		t.Errorf("first line = %q, wanted the largest package", lines[0])
+	}
+	if !strings.Contains(lines[9], "pkg-02=1.0-r0") {
+		t.Errorf("tenth line = %q, wanted the tenth largest package", lines[9])
+	}
+	if strings.TrimSpace(lines[10]) != "and 2 more" {
+		t.Errorf("eleventh line = %q", lines[10])
+	}
+	if strings.TrimSpace(lines[11]) != "12 packages, 66.0 MiB in total" {
+		t.Errorf("last line = %q", lines[11])
+	}
+	if pkgs[0].Name != "pkg-00" {
+		t.Error("sizeBreakdown() reordered its argument")
+	}
+}
+
+func TestCheckImageSizes(t *testing.T) {
+	sizes, diags := imageSizes(map[string]imagesbom{
+		"index": {},
+		"amd64": {compressedSize: 100, uncompressedSize: 300},
+		"arm64": {compressedSize: 90, uncompressedSize: 250},
+	})
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if got := len(sizes.Elements()); got != 2 {
+		t.Fatalf("imageSizes() has %d architectures, wanted 2", got)
+	}
+	if got, ok := sizes.Elements()["amd64"].(types.Object); !ok || !got.Equal(types.ObjectValueMust(imageSizeSchema.AttrTypes, map[string]attr.Value{
+		"compressed":   types.Int64Value(100),
+		"uncompressed": types.Int64Value(300),
+	})) {
+		t.Errorf("amd64 sizes = %v", got)
+	}
+
+	if diags := checkImageSizes(sizes, types.Int64Value(100), types.Int64Null()); diags.HasError() {
+		t.Errorf("checkImageSizes() = %v, wanted no errors at the limit", diags)
+	}
+	diags = checkImageSizes(sizes, types.Int64Value(95), types.Int64Value(260))
+	if got := diags.ErrorsCount(); got != 2 {
+		t.Fatalf("checkImageSizes() = %v, wanted errors for amd64 compressed and uncompressed", diags)
+	}
+	for _, d := range diags {
+		if !strings.Contains(d.Detail(), "amd64") {
+			t.Errorf("unexpected error %q", d.Detail())
+		}
+	}
+}
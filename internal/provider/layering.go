@@ -0,0 +1,538 @@
+package provider
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Layering strategies. apko implements "origin" itself, the rest are
+// implemented here by splitting the single layer apko builds when it isn't
+// asked to do any layering.
+const (
+	layeringOrigin       = "origin"
+	layeringPackage      = "package"
+	layeringSizeBalanced = "size-balanced"
+	layeringSharedBase   = "shared-base"
+)
+
+var layeringStrategies = []string{layeringOrigin, layeringPackage, layeringSizeBalanced, layeringSharedBase}
+
+// installedDB is where apk records the installed packages and their files.
+const installedDB = "usr/lib/apk/db/installed"
+
+var errNoInstalledDB = fmt.Errorf("%s not found", installedDB)
+
+// withBaseConfig returns the layering configuration with the packages of
+// base_config, if it is set, as the base packages.
+func (c *LayeringConfig) withBaseConfig() (*LayeringConfig, error) {
+	if c == nil || c.BaseConfig.IsNull() || c.BaseConfig.IsUnknown() {
+		return c, nil
+	}
+	var ic types.ImageConfiguration
+	if diags := assignValue(c.BaseConfig, &ic); diags.HasError() {
+		return nil, fmt.Errorf("assigning value: %v", diags.Errors())
+	}
+	out := *c
+	out.BasePackages = ic.Contents.Packages
+	return &out, nil
+}
+
+// layerer splits images into layers using one of the strategies apko doesn't
+// implement.
+type layerer struct {
+	strategy string
+	budget   int
+	// base lists the packages of the base image for the shared-base strategy,
+	// either as plain names or pinned as name=version.
+	base []string
+	// from overrides base when the image is built with base_layers_from.
+	from *baseLayers
+}
+
+// newLayerer takes over the layering of ic if its strategy is one that apko
+// doesn't implement, or if from is non-nil, which forces the shared-base
+// strategy. It clears the layering from ic so that apko builds a single layer
+// for us to split, and returns nil if apko should do the layering itself.
+func newLayerer(ic *types.ImageConfiguration, popts ProviderOpts, from *baseLayers) *layerer {
+	if from != nil {
+		l := &layerer{
+			strategy: layeringSharedBase,
+			budget:   defaultBaseLayersBudget,
+			from:     from,
+		}
+		if ic.Layering != nil && ic.Layering.Budget > 0 {
+			l.budget = ic.Layering.Budget
+		}
+		ic.Layering = nil
+		return l
+	}
+
+	if ic.Layering == nil || ic.Layering.Strategy == layeringOrigin || !slices.Contains(layeringStrategies, ic.Layering.Strategy) {
+		return nil
+	}
+	l := &layerer{
+		strategy: ic.Layering.Strategy,
+		budget:   ic.Layering.Budget,
+	}
+	if popts.layering != nil {
+		l.base = popts.layering.BasePackages
+	}
+	ic.Layering = nil
+	return l
+}
+
+// buildLayers builds the layers of bc, splitting them according to the
+// layering strategy if l is non-nil. The split layers are written to dir.
+func (l *layerer) buildLayers(ctx context.Context, bc *build.Context, dir string) ([]v1.Layer, error) {
+	layers, err := bc.BuildLayers(ctx)
+	if err != nil || l == nil {
+		return layers, err
+	}
+	if len(layers) != 1 {
+		return nil, fmt.Errorf("expected a single layer to split, got %d", len(layers))
+	}
+
+	pkgs, err := readInstalled(layers[0])
+	if err != nil {
+		return nil, fmt.Errorf("reading installed packages: %w", err)
+	}
+	base := l.base
+	if l.from != nil {
+		base = l.from.forArch(bc.Arch())
+	}
+	groups, err := l.group(pkgs, base)
+	if err != nil {
+		return nil, fmt.Errorf("grouping packages: %w", err)
+	}
+
+	log := clog.FromContext(ctx)
+	log.Infof("Building %d layers with %s strategy and budget %d", len(groups), l.strategy, l.budget)
+	for i, g := range groups {
+		log.Infof("  layer[%d]:", i)
+		for _, pkg := range g.pkgs {
+			log.Infof("    - %s=%s", pkg.name, pkg.version)
+		}
+	}
+
+	return splitLayer(layers[0], groups, dir)
+}
+
+// group partitions pkgs according to the layering strategy.
+func (l *layerer) group(pkgs []*installedPackage, base []string) ([]*layerGroup, error) {
+	switch l.strategy {
+	case layeringPackage:
+		return groupByPackage(pkgs, l.budget), nil
+	case layeringSizeBalanced:
+		return groupBySizeBalanced(pkgs, l.budget), nil
+	case layeringSharedBase:
+		// With base_layers_from, the base image may not have been built for
+		// every architecture, in which case nothing is shared.
+		if len(base) == 0 && l.from == nil {
+			return nil, fmt.Errorf("layering strategy %q requires default_layering.base_packages or base_config to be set", l.strategy)
+		}
+		return groupBySharedBase(pkgs, base, l.budget), nil
+	default:
+		return nil, fmt.Errorf("unrecognized layering strategy %q", l.strategy)
+	}
+}
+
+// installedPackage is a package entry from the installed database.
+type installedPackage struct {
+	name, version string
+	size          uint64
+	files         []string
+	// entry is the package's raw installed database entry, which is copied
+	// into the layer holding the package.
+	entry []byte
+}
+
+// parseInstalled parses an apk installed database.
+func parseInstalled(r io.Reader) ([]*installedPackage, error) {
+	var (
+		pkgs []*installedPackage
+		pkg  *installedPackage
+		dir  string
+		buf  bytes.Buffer
+	)
+	flush := func() {
+		if pkg != nil {
+			// Entries are separated by a blank line.
+			buf.WriteString("\n")
+			pkg.entry = slices.Clone(buf.Bytes())
+			pkgs = append(pkgs, pkg)
+		}
+		pkg, dir = nil, ""
+		buf.Reset()
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed installed database line %q", line)
+		}
+		if pkg == nil {
+			pkg = &installedPackage{}
+		}
+		switch key {
+		case "P":
+			pkg.name = val
+		case "V":
+			pkg.version = val
+		case "I":
+			size, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing installed size of %s: %w", pkg.name, err)
+			}
+			pkg.size = size
+		case "F":
+			dir = val
+		case "R":
+			pkg.files = append(pkg.files, path.Join(dir, val))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return pkgs, nil
+}
+
+// readInstalled reads the installed database from a layer.
+func readInstalled(l v1.Layer) ([]*installedPackage, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errNoInstalledDB
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == installedDB {
+			return parseInstalled(tr)
+		}
+	}
+}
+
+// layerGroup is a set of packages that share a layer.
+type layerGroup struct {
+	pkgs []*installedPackage
+	size uint64
+}
+
+func (g *layerGroup) add(pkgs ...*installedPackage) {
+	for _, pkg := range pkgs {
+		g.pkgs = append(g.pkgs, pkg)
+		g.size += pkg.size
+	}
+}
+
+// tiebreaker orders groups of identical size, like apko does.
+func (g *layerGroup) tiebreaker() string {
+	var t string
+	for _, pkg := range g.pkgs {
+		t = max(t, pkg.name)
+	}
+	return t
+}
+
+// sortGroups orders groups by descending size, and the packages in each
+// group by name, so that the layers are stable across builds.
+func sortGroups(groups []*layerGroup) {
+	slices.SortFunc(groups, func(a, b *layerGroup) int {
+		return cmp.Or(
+			cmp.Compare(b.size, a.size),
+			cmp.Compare(a.tiebreaker(), b.tiebreaker()))
+	})
+	for _, g := range groups {
+		slices.SortFunc(g.pkgs, func(a, b *installedPackage) int {
+			return cmp.Compare(a.name, b.name)
+		})
+	}
+}
+
+// groupByPackage gives each of the largest packages its own layer, and merges
+// the rest into one layer so that there are at most budget groups.
+func groupByPackage(pkgs []*installedPackage, budget int) []*layerGroup {
+	groups := make([]*layerGroup, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		g := &layerGroup{}
+		g.add(pkg)
+		groups = append(groups, g)
+	}
+	sortGroups(groups)
+
+	if len(groups) > budget {
+		cutoff := max(budget-1, 0) // Even if budget == 0, we want 1 group.
+
+		merged := &layerGroup{}
+		for _, g := range groups[cutoff:] {
+			merged.add(g.pkgs...)
+		}
+		groups = append(groups[:cutoff], merged)
+		sortGroups(groups[cutoff:])
+	}
+	return groups
+}
+
+// groupBySizeBalanced bin-packs packages into at most budget groups of
+// roughly equal installed size, placing the largest packages first.
+func groupBySizeBalanced(pkgs []*installedPackage, budget int) []*layerGroup {
+	n := min(max(budget, 1), len(pkgs))
+	groups := make([]*layerGroup, n)
+	for i := range groups {
+		groups[i] = &layerGroup{}
+	}
+
+	sorted := slices.Clone(pkgs)
+	slices.SortFunc(sorted, func(a, b *installedPackage) int {
+		return cmp.Or(
+			cmp.Compare(b.size, a.size),
+			cmp.Compare(a.name, b.name))
+	})
+	for _, pkg := range sorted {
+		smallest := slices.MinFunc(groups, func(a, b *layerGroup) int {
+			return cmp.Compare(a.size, b.size)
+		})
+		smallest.add(pkg)
+	}
+
+	sortGroups(groups)
+	return groups
+}
+
+// groupBySharedBase places the packages that are also in the base image in a
+// leading layer of their own, so that images built on the same base share it,
+// and gives the remaining budget to the other packages as groupByPackage does.
+func groupBySharedBase(pkgs []*installedPackage, base []string, budget int) []*layerGroup {
+	versions := make(map[string]string, len(base))
+	for _, b := range base {
+		name, version, _ := strings.Cut(b, "=")
+		if idx := strings.IndexAny(name, "<>~"); idx >= 0 {
+			name, version = name[:idx], ""
+		}
+		versions[name] = version
+	}
+
+	shared := &layerGroup{}
+	var rest []*installedPackage
+	for _, pkg := range pkgs {
+		// An unpinned base package matches any version, but a pinned one
+		// only matches the same version, since anything else would produce
+		// a different layer.
+		if version, ok := versions[pkg.name]; ok && (version == "" || version == pkg.version) {
+			shared.add(pkg)
+		} else {
+			rest = append(rest, pkg)
+		}
+	}
+	if len(shared.pkgs) == 0 {
+		return groupByPackage(pkgs, budget)
+	}
+
+	groups := []*layerGroup{shared}
+	sortGroups(groups)
+	if len(rest) != 0 {
+		groups = append(groups, groupByPackage(rest, max(budget-1, 1))...)
+	}
+	return groups
+}
+
+// layerWriter accumulates the entries of one of the split layers.
+type layerWriter struct {
+	f    *os.File
+	tw   *tar.Writer
+	dirs map[string]bool
+}
+
+func newSplitLayerWriter(dir string) (*layerWriter, error) {
+	f, err := os.CreateTemp(dir, "layer-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	return &layerWriter{
+		f:    f,
+		tw:   tar.NewWriter(f),
+		dirs: map[string]bool{},
+	}, nil
+}
+
+// writeParents writes any parent directories of name that w is missing.
+func (w *layerWriter) writeParents(name string, dirs map[string]*tar.Header, hdr *tar.Header) error {
+	var parents []string
+	for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+		parents = append(parents, p)
+	}
+	for _, p := range slices.Backward(parents) {
+		if w.dirs[p] {
+			continue
+		}
+		d, ok := dirs[p]
+		if !ok {
+			continue
+		}
+		// Like apko, use the timestamp of the entry being written, so
+		// that the directory doesn't hurt deduplication of this layer.
+		// The real directory entry ends up in the top layer.
+		dh := *d
+		dh.ModTime = hdr.ModTime
+		if err := w.tw.WriteHeader(&dh); err != nil {
+			return fmt.Errorf("writing header %s: %w", dh.Name, err)
+		}
+		w.dirs[p] = true
+	}
+	return nil
+}
+
+func (w *layerWriter) finalize() (v1.Layer, error) {
+	if err := w.tw.Close(); err != nil {
+		return nil, fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := w.f.Close(); err != nil {
+		return nil, fmt.Errorf("closing %s: %w", w.f.Name(), err)
+	}
+	return tarball.LayerFromFile(w.f.Name(), tarball.WithMediaType(ggcrtypes.OCILayer))
+}
+
+// splitLayer partitions the files of a single layer image into a layer per
+// group, followed by a top layer holding every directory and any files that
+// don't belong to a package. Each group's layer also gets a partial installed
+// database to satisfy scanners, which the full one in the top layer overlays.
+func splitLayer(l v1.Layer, groups []*layerGroup, dir string) ([]v1.Layer, error) {
+	writers := make([]*layerWriter, 0, len(groups)+1)
+	defer func() {
+		for _, w := range writers {
+			w.f.Close()
+		}
+	}()
+	owner := map[string]*layerWriter{}
+	for _, g := range groups {
+		w, err := newSplitLayerWriter(dir)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, w)
+		for _, pkg := range g.pkgs {
+			for _, f := range pkg.files {
+				owner[f] = w
+			}
+		}
+	}
+	top, err := newSplitLayerWriter(dir)
+	if err != nil {
+		return nil, err
+	}
+	writers = append(writers, top)
+
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	dirs := map[string]*tar.Header{}
+	placed := map[string]*layerWriter{}
+	buf := make([]byte, 1<<20)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		w := top
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			dirs[hdr.Name] = hdr
+			top.dirs[hdr.Name] = true
+		case hdr.Typeflag == tar.TypeLink && placed[hdr.Linkname] != nil:
+			// Hard links have to live in the same layer as their target.
+			w = placed[hdr.Linkname]
+		case owner[hdr.Name] != nil:
+			w = owner[hdr.Name]
+		}
+
+		if err := w.writeParents(hdr.Name, dirs, hdr); err != nil {
+			return nil, err
+		}
+		if err := w.tw.WriteHeader(hdr); err != nil {
+			return nil, fmt.Errorf("writing header %s: %w", hdr.Name, err)
+		}
+		if _, err := io.CopyBuffer(w.tw, tr, buf); err != nil {
+			return nil, fmt.Errorf("copying %s: %w", hdr.Name, err)
+		}
+		placed[hdr.Name] = w
+
+		if hdr.Name != installedDB {
+			continue
+		}
+		for i, g := range groups {
+			w := writers[i]
+			var entries bytes.Buffer
+			for _, pkg := range g.pkgs {
+				entries.Write(pkg.entry)
+			}
+
+			// Only the size should be different across layers.
+			idb := *hdr
+			idb.Size = int64(entries.Len())
+
+			if err := w.writeParents(idb.Name, dirs, hdr); err != nil {
+				return nil, err
+			}
+			if err := w.tw.WriteHeader(&idb); err != nil {
+				return nil, fmt.Errorf("writing header %s: %w", idb.Name, err)
+			}
+			if _, err := io.Copy(w.tw, &entries); err != nil {
+				return nil, fmt.Errorf("copying %s: %w", idb.Name, err)
+			}
+		}
+	}
+
+	layers := make([]v1.Layer, 0, len(writers))
+	for i, w := range writers {
+		l, err := w.finalize()
+		if err != nil {
+			return nil, fmt.Errorf("finalizing layer[%d]: %w", i, err)
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
@@ -1,12 +1,24 @@
 package provider
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"chainguard.dev/apko/pkg/build/types"
 	ocitesting "github.com/chainguard-dev/terraform-provider-oci/testing"
 	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
 	"github.com/hashicorp/terraform-plugin-testing/terraform"
@@ -300,3 +312,396 @@ resource "apko_build" "empty_layering" {
 		},
 	})
 }
+
+// TestProviderLayeringStrategies tests the layering strategies implemented by
+// the provider rather than apko.
+func TestProviderLayeringStrategies(t *testing.T) {
+	for _, tc := range []struct {
+		strategy     string
+		budget       int
+		basePackages []string
+		// wantLayers is the number of layers, including the top layer.
+		wantLayers int
+		// wantFirst are files expected in the first layer.
+		wantFirst []string
+	}{{
+		// The largest package gets a layer, the other three share one.
+		strategy:   "package",
+		budget:     2,
+		wantLayers: 3,
+	}, {
+		strategy:   "size-balanced",
+		budget:     2,
+		wantLayers: 3,
+	}, {
+		// wolfi-baselayout gets the leading layer, and the other three
+		// packages share the remaining budget.
+		strategy:     "shared-base",
+		budget:       3,
+		basePackages: []string{"wolfi-baselayout"},
+		wantLayers:   4,
+		wantFirst:    []string{"etc/os-release"},
+	}} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			repo, cleanup := ocitesting.SetupRepository(t, "test-layering-"+tc.strategy)
+			defer cleanup()
+
+			resource.Test(t, resource.TestCase{
+				PreCheck: func() { testAccPreCheck(t) },
+				ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+					"apko": providerserver.NewProtocol6WithError(&Provider{
+						repositories:       []string{"https://packages.wolfi.dev/os"},
+						buildRespositories: []string{"./packages"},
+						keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+						archs:              []string{"x86_64"},
+						packages:           []string{"wolfi-baselayout"},
+						layering: &LayeringConfig{
+							Strategy:     tc.strategy,
+							Budget:       tc.budget,
+							BasePackages: tc.basePackages,
+						},
+					}),
+				},
+				Steps: []resource.TestStep{{
+					Config: fmt.Sprintf(`
+data "apko_config" "strategy" {
+  config_contents = <<EOF
+contents:
+  packages:
+    - ca-certificates-bundle=20250911-r0
+    - glibc-locale-posix=2.42-r2
+    - tzdata=2025b-r2
+EOF
+}
+
+resource "apko_build" "strategy" {
+  repo   = %q
+  config = data.apko_config.strategy.config
+}
+`, repo.String()),
+					Check: resource.ComposeTestCheckFunc(
+						resource.TestCheckResourceAttr("data.apko_config.strategy", "config.layering.strategy", tc.strategy),
+						resource.TestCheckFunc(func(s *terraform.State) error {
+							rs, ok := s.RootModule().Resources["apko_build.strategy"]
+							if !ok {
+								return fmt.Errorf("resource not found: apko_build.strategy")
+							}
+
+							img, err := crane.Pull(rs.Primary.Attributes["image_ref"])
+							if err != nil {
+								return fmt.Errorf("failed to pull image: %v", err)
+							}
+							layers, err := img.Layers()
+							if err != nil {
+								return fmt.Errorf("failed to get layers: %v", err)
+							}
+							if len(layers) != tc.wantLayers {
+								return fmt.Errorf("expected %d layers from %s layering with budget %d, got %d layers",
+									tc.wantLayers, tc.strategy, tc.budget, len(layers))
+							}
+
+							files, err := layerNames(layers[0])
+							if err != nil {
+								return err
+							}
+							for _, want := range tc.wantFirst {
+								if !slices.Contains(files, want) {
+									return fmt.Errorf("expected %s in the first layer, got %v", want, files)
+								}
+							}
+							return nil
+						}),
+					),
+				}},
+			})
+		})
+	}
+}
+
+func testPackage(name string, size uint64, files ...string) *installedPackage {
+	return &installedPackage{name: name, version: "1.0-r0", size: size, files: files}
+}
+
+func groupNames(groups []*layerGroup) [][]string {
+	var names [][]string
+	for _, g := range groups {
+		var n []string
+		for _, pkg := range g.pkgs {
+			n = append(n, pkg.name)
+		}
+		names = append(names, n)
+	}
+	return names
+}
+
+func TestLayeringGroups(t *testing.T) {
+	pkgs := []*installedPackage{
+		testPackage("a", 100),
+		testPackage("b", 60),
+		testPackage("c", 50),
+		testPackage("d", 10),
+		testPackage("e", 5),
+	}
+
+	for _, tc := range []struct {
+		name  string
+		group func() []*layerGroup
+		want  [][]string
+	}{{
+		name:  "package",
+		group: func() []*layerGroup { return groupByPackage(pkgs, 3) },
+		want:  [][]string{{"a"}, {"b"}, {"c", "d", "e"}},
+	}, {
+		name:  "package within budget",
+		group: func() []*layerGroup { return groupByPackage(pkgs, 10) },
+		want:  [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}},
+	}, {
+		// a=100 and b+c=110 are balanced, and the small packages fill in.
+		name:  "size-balanced",
+		group: func() []*layerGroup { return groupBySizeBalanced(pkgs, 2) },
+		want:  [][]string{{"a", "d", "e"}, {"b", "c"}},
+	}, {
+		name:  "size-balanced within budget",
+		group: func() []*layerGroup { return groupBySizeBalanced(pkgs[:2], 5) },
+		want:  [][]string{{"a"}, {"b"}},
+	}, {
+		name:  "shared-base",
+		group: func() []*layerGroup { return groupBySharedBase(pkgs, []string{"d", "e=1.0-r0"}, 3) },
+		want:  [][]string{{"d", "e"}, {"a"}, {"b", "c"}},
+	}, {
+		// A base package pinned to another version isn't shared.
+		name:  "shared-base version mismatch",
+		group: func() []*layerGroup { return groupBySharedBase(pkgs, []string{"d", "e=2.0-r0"}, 3) },
+		want:  [][]string{{"d"}, {"a"}, {"b", "c", "e"}},
+	}, {
+		name:  "shared-base without shared packages",
+		group: func() []*layerGroup { return groupBySharedBase(pkgs, []string{"z"}, 2) },
+		want:  [][]string{{"a"}, {"b", "c", "d", "e"}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := groupNames(tc.group()); !slices.EqualFunc(got, tc.want, slices.Equal) {
+				t.Errorf("groups = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewLayerer(t *testing.T) {
+	popts := ProviderOpts{layering: &LayeringConfig{Strategy: "shared-base", Budget: 3, BasePackages: []string{"a"}}}
+	from := &baseLayers{archPackages: map[types.Architecture][]string{"arm64": {"b=1.0-r0"}}}
+
+	for _, tc := range []struct {
+		name     string
+		layering *types.Layering
+		from     *baseLayers
+		want     *layerer
+	}{{
+		name:     "origin is left to apko",
+		layering: &types.Layering{Strategy: "origin", Budget: 5},
+	}, {
+		name: "no layering",
+	}, {
+		name:     "provider strategy",
+		layering: &types.Layering{Strategy: "shared-base", Budget: 3},
+		want:     &layerer{strategy: "shared-base", budget: 3, base: []string{"a"}},
+	}, {
+		name:     "base_layers_from overrides the strategy",
+		layering: &types.Layering{Strategy: "origin", Budget: 5},
+		from:     from,
+		want:     &layerer{strategy: "shared-base", budget: 5, from: from},
+	}, {
+		name: "base_layers_from without layering",
+		from: from,
+		want: &layerer{strategy: "shared-base", budget: defaultBaseLayersBudget, from: from},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ic := types.ImageConfiguration{Layering: tc.layering}
+			got := newLayerer(&ic, popts, tc.from)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("newLayerer() = %+v, want %+v", got, tc.want)
+			}
+			if got != nil && ic.Layering != nil {
+				t.Errorf("layering was left to apko: %+v", ic.Layering)
+			}
+			if got == nil && ic.Layering != tc.layering {
+				t.Errorf("layering was changed to %+v", ic.Layering)
+			}
+		})
+	}
+
+	// Only the packages of the base image for the architecture being built
+	// are shared.
+	if got := from.forArch("arm64"); !slices.Equal(got, []string{"b=1.0-r0"}) {
+		t.Errorf("forArch(arm64) = %v", got)
+	}
+	if got := from.forArch("amd64"); got != nil {
+		t.Errorf("forArch(amd64) = %v, want nil", got)
+	}
+}
+
+func TestLayeringConfigWithBaseConfig(t *testing.T) {
+	if got, err := (*LayeringConfig)(nil).withBaseConfig(); err != nil || got != nil {
+		t.Errorf("withBaseConfig(nil) = %v, %v, wanted nil", got, err)
+	}
+
+	cfg := &LayeringConfig{Strategy: "shared-base", Budget: 3, BasePackages: []string{"a"}}
+	if got, err := cfg.withBaseConfig(); err != nil || got != cfg {
+		t.Errorf("withBaseConfig(no base_config) = %v, %v, wanted it unchanged", got, err)
+	}
+
+	base, diags := generateValue(types.ImageConfiguration{
+		Contents: types.ImageContents{Packages: []string{"wolfi-baselayout=20230201-r24", "ca-certificates-bundle=20250911-r0"}},
+	})
+	if diags.HasError() {
+		t.Fatalf("generateValue() = %v", diags.Errors())
+	}
+	cfg = &LayeringConfig{Strategy: "shared-base", Budget: 3, BaseConfig: base.(basetypes.ObjectValue)}
+	got, err := cfg.withBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"wolfi-baselayout=20230201-r24", "ca-certificates-bundle=20250911-r0"}; !slices.Equal(got.BasePackages, want) {
+		t.Errorf("BasePackages = %v, wanted %v", got.BasePackages, want)
+	}
+	if cfg.BasePackages != nil {
+		t.Errorf("withBaseConfig() modified its receiver: %v", cfg.BasePackages)
+	}
+}
+
+func TestParseInstalled(t *testing.T) {
+	pkgs, err := parseInstalled(strings.NewReader(testInstalledDB))
+	if err != nil {
+		t.Fatalf("parseInstalled() = %v", err)
+	}
+	if len(pkgs) != 2 {
+		t.Fatalf("got %d packages, want 2", len(pkgs))
+	}
+	if got, want := pkgs[0].files, []string{"usr/bin/foo", "usr/bin/foo-link"}; !slices.Equal(got, want) {
+		t.Errorf("foo files = %v, want %v", got, want)
+	}
+	if got, want := pkgs[1].files, []string{"etc/bar.conf"}; !slices.Equal(got, want) {
+		t.Errorf("bar files = %v, want %v", got, want)
+	}
+	if pkgs[0].size != 300 || pkgs[1].size != 100 {
+		t.Errorf("sizes = %d, %d, want 300, 100", pkgs[0].size, pkgs[1].size)
+	}
+	if got := string(pkgs[0].entry) + string(pkgs[1].entry); got != testInstalledDB {
+		t.Errorf("entries = %q, want %q", got, testInstalledDB)
+	}
+}
+
+const testInstalledDB = `P:foo
+V:1.0-r0
+I:300
+F:usr/bin
+R:foo
+R:foo-link
+
+P:bar
+V:2.0-r0
+I:100
+F:etc
+R:bar.conf
+
+`
+
+func TestSplitLayer(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	epoch := time.Unix(0, 0)
+	for _, f := range []struct {
+		name, content, link string
+		typ                 byte
+	}{
+		{name: "etc", typ: tar.TypeDir},
+		{name: "etc/bar.conf", content: "bar", typ: tar.TypeReg},
+		{name: "etc/hostname", content: "unowned", typ: tar.TypeReg},
+		{name: "usr", typ: tar.TypeDir},
+		{name: "usr/bin", typ: tar.TypeDir},
+		{name: "usr/bin/foo", content: "foo", typ: tar.TypeReg},
+		{name: "usr/bin/foo-link", link: "usr/bin/foo", typ: tar.TypeLink},
+		{name: "usr/lib", typ: tar.TypeDir},
+		{name: "usr/lib/apk", typ: tar.TypeDir},
+		{name: "usr/lib/apk/db", typ: tar.TypeDir},
+		{name: installedDB, content: testInstalledDB, typ: tar.TypeReg},
+	} {
+		hdr := &tar.Header{Name: f.name, Typeflag: f.typ, Linkname: f.link, Mode: 0o644, Size: int64(len(f.content)), ModTime: epoch}
+		if f.typ == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	single, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs, err := readInstalled(single)
+	if err != nil {
+		t.Fatalf("readInstalled() = %v", err)
+	}
+	layers, err := splitLayer(single, groupByPackage(pkgs, 5), t.TempDir())
+	if err != nil {
+		t.Fatalf("splitLayer() = %v", err)
+	}
+
+	want := [][]string{
+		{"usr", "usr/bin", "usr/bin/foo", "usr/bin/foo-link", "usr/lib", "usr/lib/apk", "usr/lib/apk/db", installedDB},
+		{"etc", "etc/bar.conf", "usr", "usr/lib", "usr/lib/apk", "usr/lib/apk/db", installedDB},
+		{"etc", "etc/hostname", "usr", "usr/bin", "usr/lib", "usr/lib/apk", "usr/lib/apk/db", installedDB},
+	}
+	if len(layers) != len(want) {
+		t.Fatalf("got %d layers, want %d", len(layers), len(want))
+	}
+	for i, l := range layers {
+		got, err := layerNames(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want[i]) {
+			t.Errorf("layer %d = %v, want %v", i, got, want[i])
+		}
+	}
+
+	// Each package layer carries only its own installed database entry.
+	files, err := layerFiles(layers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := files[installedDB].size, int64(len(pkgs[1].entry)); got != want {
+		t.Errorf("partial installed db size = %d, want %d", got, want)
+	}
+}
+
+// layerNames lists the entries of a layer in order.
+func layerNames(l v1.Layer) ([]string, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var names []string
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, hdr.Name)
+	}
+}
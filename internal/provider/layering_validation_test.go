@@ -37,7 +37,7 @@ resource "apko_build" "test" {
   })
 }
 `,
-				ExpectError: regexp.MustCompile(`Attribute default_layering.strategy value must be one of: \["origin"\]`),
+				ExpectError: regexp.MustCompile(`Attribute default_layering.strategy value must be one of: \["origin" "package" "size-balanced" "shared-base"\]`),
 			},
 		},
 	})
@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"golang.org/x/sync/errgroup"
+)
+
+// mirrorRefs returns the references of the image dig in each of repos, or
+// null if there are none.
+func mirrorRefs(dig string, repos []string) (types.Map, error) {
+	if len(repos) == 0 {
+		return types.MapNull(basetypes.StringType{}), nil
+	}
+	d, err := name.NewDigest(dig)
+	if err != nil {
+		return types.Map{}, fmt.Errorf("parsing image_ref: %w", err)
+	}
+	refs := make(map[string]attr.Value, len(repos))
+	for _, r := range repos {
+		repo, err := name.NewRepository(r)
+		if err != nil {
+			return types.Map{}, fmt.Errorf("parsing mirror repo %q: %w", r, err)
+		}
+		refs[r] = types.StringValue(repo.Digest(d.DigestStr()).String())
+	}
+	v, diags := types.MapValue(basetypes.StringType{}, refs)
+	if diags.HasError() {
+		return types.Map{}, fmt.Errorf("%v", diags.Errors())
+	}
+	return v, nil
+}
+
+// replicate pushes the index dig, which has already been pushed to its own
+// repository, to each of repos concurrently. Its blobs are read back from
+// that repository, so registries that support it mount them rather than
+// having them uploaded again.
+func (p ProviderOpts) replicate(ctx context.Context, dig name.Digest, repos []string) error {
+	if len(repos) == 0 {
+		return nil
+	}
+	idx, err := remote.Index(dig, append(p.ropts, remote.WithContext(ctx))...)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", dig, err)
+	}
+	pusher, err := remote.NewPusher(p.ropts...)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu   sync.Mutex
+		errg errgroup.Group
+	)
+	errs := make(map[string]error, len(repos))
+	for _, r := range repos {
+		errg.Go(func() error {
+			repo, err := name.NewRepository(r)
+			if err != nil {
+				return fmt.Errorf("parsing mirror repo %q: %w", r, err)
+			}
+			ref := repo.Digest(dig.DigestStr())
+			if err := retry(ctx, p.retryBackoff(), func(ctx context.Context) error {
+				return pusher.Push(ctx, ref, idx)
+			}); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs[r] = err
+			}
+			return nil
+		})
+	}
+	if err := errg.Wait(); err != nil {
+		return err
+	}
+	// Report every mirror that failed, not just the first.
+	var failed []error
+	for _, r := range repos {
+		if err, ok := errs[r]; ok {
+			failed = append(failed, fmt.Errorf("pushing to %s: %w", r, err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// stringList returns the strings of a list, or nil if it is null or unknown.
+func stringList(ctx context.Context, l types.List) ([]string, error) {
+	if l.IsNull() || l.IsUnknown() {
+		return nil, nil
+	}
+	var out []string
+	if diags := l.ElementsAs(ctx, &out, false); diags.HasError() {
+		return nil, fmt.Errorf("reading list: %v", diags.Errors())
+	}
+	return out, nil
+}
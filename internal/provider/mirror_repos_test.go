@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	one := httptest.NewServer(registry.New())
+	defer one.Close()
+	two := httptest.NewServer(registry.New())
+	defer two.Close()
+
+	host := func(url string) string { return strings.TrimPrefix(url, "http://") }
+
+	idx, err := random.Index(64, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := name.NewDigest(host(one.URL) + "/primary@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(dig, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// One mirror in the same registry, which mounts the blobs, and one in
+	// another.
+	mirrors := []string{host(one.URL) + "/mirror", host(two.URL) + "/mirror"}
+	var popts ProviderOpts
+	if err := popts.replicate(ctx, dig, mirrors); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := mirrorRefs(dig.String(), mirrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(refs.Elements()); got != len(mirrors) {
+		t.Fatalf("got %d mirror refs, wanted %d", got, len(mirrors))
+	}
+	for _, m := range mirrors {
+		v, ok := refs.Elements()[m].(types.String)
+		if !ok {
+			t.Fatalf("no mirror ref for %s", m)
+		}
+		if want := m + "@" + h.String(); v.ValueString() != want {
+			t.Errorf("mirror ref = %s, wanted %s", v.ValueString(), want)
+		}
+		ref, err := name.NewDigest(v.ValueString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := remote.Index(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reading every image checks that the blobs were copied too.
+		im, err := got.IndexManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, desc := range im.Manifests {
+			img, err := got.Image(desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range layers {
+				rc, err := l.Compressed()
+				if err != nil {
+					t.Fatalf("%s: %v", m, err)
+				}
+				rc.Close()
+			}
+		}
+	}
+
+	if refs, err := mirrorRefs(dig.String(), nil); err != nil {
+		t.Fatal(err)
+	} else if !refs.IsNull() {
+		t.Errorf("mirrorRefs() = %v, wanted null", refs)
+	}
+}
@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var httpURLRegexp = regexp.MustCompile(`^https?://[^/]+`)
+
+// fetchTransport returns the transport used to fetch APKINDEX, APK and key
+// files from their repositories.
+func (p ProviderOpts) fetchTransport() http.RoundTripper {
+	var rt http.RoundTripper = http.DefaultTransport
+	if p.transport != nil {
+		rt = p.transport
+	}
+	if p.downloads != nil {
+		rt = &limitTransport{sem: p.downloads, inner: rt}
+	}
+	if len(p.repositoryAuth) != 0 {
+		rt = &authTransport{creds: p.repositoryAuth, inner: rt}
+	}
+	if len(p.repositoryMirrors) != 0 {
+		rt = &mirrorTransport{mirrors: p.repositoryMirrors, inner: rt}
+	}
+	return &retryTransport{backoff: p.retryBackoff(), inner: rt}
+}
+
+// mirrorTransport sends requests for repositories to their mirrors, by
+// replacing the longest matching prefix of each URL. This happens below apko
+// and the cache, so that the configs, SBOMs and cache keys keep the original
+// URLs.
+type mirrorTransport struct {
+	mirrors map[string]string
+	inner   http.RoundTripper
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, ok := rewriteURL(t.mirrors, req.URL)
+	if !ok {
+		return t.inner.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL = u
+	req.Host = ""
+	return t.inner.RoundTrip(req)
+}
+
+// rewriteURL replaces the longest prefix of u that is in mirrors, reporting
+// whether there was one.
+func rewriteURL(mirrors map[string]string, u *url.URL) (*url.URL, bool) {
+	s := u.String()
+	var from string
+	for prefix := range mirrors {
+		if len(prefix) > len(from) && hasPathPrefix(s, prefix) {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return nil, false
+	}
+	rewritten, err := url.Parse(strings.TrimSuffix(mirrors[from], "/") + strings.TrimPrefix(s, strings.TrimSuffix(from, "/")))
+	if err != nil {
+		return nil, false
+	}
+	return rewritten, true
+}
+
+// hasPathPrefix reports whether s starts with prefix, ending on a path
+// boundary, so that ".../os" doesn't match ".../os-extras".
+func hasPathPrefix(s, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	rest, ok := strings.CutPrefix(s, prefix)
+	return ok && (rest == "" || strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "?"))
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRewriteURL(t *testing.T) {
+	mirrors := map[string]string{
+		"https://packages.wolfi.dev/os":         "https://mirror.example.com/wolfi/os",
+		"https://packages.wolfi.dev/os/x86_64/": "https://fast.example.com/x86_64/",
+		"https://apk.example.com":               "http://localhost:8080/apk/",
+	}
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"https://packages.wolfi.dev/os/aarch64/APKINDEX.tar.gz", "https://mirror.example.com/wolfi/os/aarch64/APKINDEX.tar.gz"},
+		{"https://packages.wolfi.dev/os/x86_64/APKINDEX.tar.gz", "https://fast.example.com/x86_64/APKINDEX.tar.gz"},
+		{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub", "https://mirror.example.com/wolfi/os/wolfi-signing.rsa.pub"},
+		{"https://apk.example.com/x86_64/foo-1.0-r0.apk", "http://localhost:8080/apk/x86_64/foo-1.0-r0.apk"},
+		{"https://packages.wolfi.dev/os-extras/x86_64/APKINDEX.tar.gz", ""},
+		{"https://packages.cgr.dev/os/x86_64/APKINDEX.tar.gz", ""},
+	} {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := rewriteURL(mirrors, u)
+		switch {
+		case tc.want == "" && ok:
+			t.Errorf("rewriteURL(%s) = %s, want no rewrite", tc.in, got)
+		case tc.want != "" && (!ok || got.String() != tc.want):
+			t.Errorf("rewriteURL(%s) = %v, %t, want %s", tc.in, got, ok, tc.want)
+		}
+	}
+}
+
+func TestMirrorTransportCache(t *testing.T) {
+	mirror := &testRepo{files: map[string]string{"/mirror/os/x86_64/foo-1.0-r0.apk": "foo"}}
+	srv := httptest.NewServer(mirror)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	popts := ProviderOpts{repositoryMirrors: map[string]string{"https://packages.example.com/os": srv.URL + "/mirror/os"}}
+	rt := &cacheTransport{cache: c, inner: popts.fetchTransport()}
+
+	const orig = "https://packages.example.com/os/x86_64/foo-1.0-r0.apk"
+	if code, body, _ := testGet(t, rt, http.MethodGet, orig); code != http.StatusOK || body != "foo" {
+		t.Fatalf("GET = %d %q, want 200 \"foo\"", code, body)
+	}
+
+	// The cache records the original URL, so offline builds of the same
+	// config find it whether or not they use the mirror.
+	u, err := url.Parse(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(ProviderOpts{apkCache: c}).available(u) {
+		t.Errorf("%s is not in the cache", orig)
+	}
+}
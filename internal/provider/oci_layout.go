@@ -0,0 +1,254 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// refNameAnnotation names an image in an OCI image layout.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// layoutLockFile serializes the updates to index.json of resources that
+// share a layout, which Terraform applies in parallel.
+const layoutLockFile = "index.json.lock"
+
+// lockLayout takes the lock on the OCI image layout at dir, creating the
+// directory if needed.
+func lockLayout(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create layout dir %q: %w", dir, err)
+	}
+	unlock, err := lockFile(filepath.Join(dir, layoutLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("lock layout %q: %w", dir, err)
+	}
+	return unlock, nil
+}
+
+// writeImageLayout adds the given image index to the OCI image layout at the
+// caller-supplied path, creating the layout if there is none, under the
+// org.opencontainers.image.ref.name annotation refName. The image previously
+// written under refName is replaced in index.json, as is the one written
+// under replaces when the image was previously named differently, but their
+// blobs are left, as other images in the layout may use them. The caller owns
+// the directory lifecycle (e.g. an execroot that is torn down by the build
+// driver).
+func writeImageLayout(dir string, ii v1.ImageIndex, refName, replaces string) error {
+	unlock, err := lockLayout(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeLockedImageLayout(dir, ii, refName, replaces)
+}
+
+// writeLockedImageLayout is writeImageLayout for callers that hold the lock.
+func writeLockedImageLayout(dir string, ii v1.ImageIndex, refName, replaces string) error {
+	lp, err := layout.FromPath(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		lp, err = layout.Write(dir, empty.Index)
+	}
+	if err != nil {
+		return fmt.Errorf("open layout %q: %w", dir, err)
+	}
+	if err := removeRefName(dir, refName, replaces); err != nil {
+		return err
+	}
+	if err := lp.ReplaceIndex(ii, match.Name(refName), layout.WithAnnotations(map[string]string{
+		refNameAnnotation: refName,
+	})); err != nil {
+		return fmt.Errorf("write layout: %w", err)
+	}
+	return nil
+}
+
+// removeRefName removes the image named replaces from the layout at dir,
+// unless that is refName, which the image is now written under.
+func removeRefName(dir, refName, replaces string) error {
+	if replaces == "" || replaces == refName {
+		return nil
+	}
+	lp, err := layout.FromPath(dir)
+	if err != nil {
+		return fmt.Errorf("open layout %q: %w", dir, err)
+	}
+	if err := lp.RemoveDescriptors(match.Name(replaces)); err != nil {
+		return fmt.Errorf("write layout: %w", err)
+	}
+	return nil
+}
+
+// layoutContains reports whether the OCI image layout at dir has the image
+// index h under refName, along with the manifests of its images.
+func layoutContains(dir string, h v1.Hash, refName string) (bool, error) {
+	lp, err := layout.FromPath(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	root, err := lp.ImageIndex()
+	if err != nil {
+		return false, err
+	}
+	im, err := root.IndexManifest()
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, desc := range im.Manifests {
+		if desc.Digest == h && desc.Annotations[refNameAnnotation] == refName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	ii, err := root.ImageIndex(h)
+	if err != nil {
+		return false, err
+	}
+	children, err := ii.IndexManifest()
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, desc := range children.Manifests {
+		rc, err := lp.Blob(desc.Digest)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		rc.Close()
+	}
+	return true, nil
+}
+
+// writeImageLayout adds idx to oci_layout_path, if it is set.
+func (data *BuildResourceModel) writeImageLayout(ctx context.Context, repo name.Repository, idx v1.ImageIndex) error {
+	dir := data.OciLayoutPath.ValueString()
+	if dir == "" {
+		return nil
+	}
+	tag, err := data.imageTag(ctx, repo)
+	if err != nil {
+		return err
+	}
+	return writeImageLayout(dir, idx, tag.String(), "")
+}
+
+// replacedRefName returns the name under which state wrote the image to the
+// same layout, if any.
+func (data *BuildResourceModel) replacedRefName(ctx context.Context, repo name.Repository, state *BuildResourceModel) (string, error) {
+	if state == nil || !state.OciLayoutPath.Equal(data.OciLayoutPath) {
+		return "", nil
+	}
+	tag, err := state.imageTag(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+	return tag.String(), nil
+}
+
+// hasImageLayout reports whether oci_layout_path, if it is set, has the
+// published image under its name.
+func (data *BuildResourceModel) hasImageLayout(ctx context.Context) (bool, error) {
+	dir := data.OciLayoutPath.ValueString()
+	if dir == "" {
+		return true, nil
+	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	dig, err := name.NewDigest(data.ImageRef.ValueString())
+	if err != nil {
+		return false, fmt.Errorf("parsing image_ref: %w", err)
+	}
+	h, err := v1.NewHash(dig.DigestStr())
+	if err != nil {
+		return false, err
+	}
+	tag, err := data.imageTag(ctx, dig.Repository)
+	if err != nil {
+		return false, err
+	}
+	unlock, err := lockLayout(dir)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	ok, err := layoutContains(dir, h, tag.String())
+	if err != nil {
+		return false, fmt.Errorf("reading layout %q: %w", dir, err)
+	}
+	return ok, nil
+}
+
+// ensureImageLayout writes the published image to oci_layout_path, unless the
+// layout there already has it, e.g. because it was deleted since, replacing
+// the image that state wrote there under another name. With plan_offline set
+// the image can't be fetched, so a missing image fails instead.
+func (data *BuildResourceModel) ensureImageLayout(ctx context.Context, state *BuildResourceModel) error {
+	dir := data.OciLayoutPath.ValueString()
+	if dir == "" {
+		return nil
+	}
+	dig, err := name.NewDigest(data.ImageRef.ValueString())
+	if err != nil {
+		return fmt.Errorf("parsing image_ref: %w", err)
+	}
+	h, err := v1.NewHash(dig.DigestStr())
+	if err != nil {
+		return err
+	}
+	tag, err := data.imageTag(ctx, dig.Repository)
+	if err != nil {
+		return err
+	}
+	refName := tag.String()
+	replaces, err := data.replacedRefName(ctx, dig.Repository, state)
+	if err != nil {
+		return err
+	}
+
+	if data.popts.planOffline {
+		if ok, err := data.hasImageLayout(ctx); err != nil || ok {
+			return err
+		}
+		return fmt.Errorf("%s is missing from the layout at %s as %s, and it can't be fetched to rewrite the layout with plan_offline set", dig, dir, refName)
+	}
+
+	unlock, err := lockLayout(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if ok, err := layoutContains(dir, h, refName); err != nil {
+		return fmt.Errorf("reading layout %q: %w", dir, err)
+	} else if ok {
+		return removeRefName(dir, refName, replaces)
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("writing %s to the layout at %s as %s", dig, dir, refName))
+	ii, err := remote.Index(dig, append(data.popts.ropts, remote.WithContext(ctx))...)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", dig, err)
+	}
+	return writeLockedImageLayout(dir, ii, refName, replaces)
+}
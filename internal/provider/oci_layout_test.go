@@ -0,0 +1,254 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"golang.org/x/sync/errgroup"
+)
+
+// layoutRefs returns the digests in the layout at dir by their ref names.
+func layoutRefs(t *testing.T, dir string) map[string]v1.Hash {
+	t.Helper()
+	lp, err := layout.FromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ii, err := lp.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ii.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]v1.Hash{}
+	for _, desc := range im.Manifests {
+		refs[desc.Annotations[refNameAnnotation]] = desc.Digest
+	}
+	return refs
+}
+
+func TestWriteImageLayout(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "layout")
+	digests := map[string]v1.Hash{}
+	write := func(ref string) {
+		t.Helper()
+		idx, err := random.Index(64, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digests[ref], err = idx.Digest(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeImageLayout(dir, idx, ref, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("example.com/a:latest")
+	write("example.com/b:latest")
+	if got := layoutRefs(t, dir); len(got) != 2 || got["example.com/a:latest"] != digests["example.com/a:latest"] || got["example.com/b:latest"] != digests["example.com/b:latest"] {
+		t.Errorf("layout refs = %v, wanted %v", got, digests)
+	}
+
+	// Writing a ref again replaces its image, leaving the other alone.
+	old := digests["example.com/a:latest"]
+	write("example.com/a:latest")
+	if got := layoutRefs(t, dir); len(got) != 2 || got["example.com/a:latest"] != digests["example.com/a:latest"] || got["example.com/b:latest"] != digests["example.com/b:latest"] {
+		t.Errorf("layout refs = %v, wanted %v", got, digests)
+	}
+
+	for _, tc := range []struct {
+		ref  string
+		h    v1.Hash
+		want bool
+	}{
+		{"example.com/a:latest", digests["example.com/a:latest"], true},
+		{"example.com/b:latest", digests["example.com/b:latest"], true},
+		{"example.com/a:latest", old, false},
+		{"example.com/c:latest", digests["example.com/a:latest"], false},
+	} {
+		got, err := layoutContains(dir, tc.h, tc.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("layoutContains(%s, %s) = %t, wanted %t", tc.h, tc.ref, got, tc.want)
+		}
+	}
+
+	if got, err := layoutContains(filepath.Join(t.TempDir(), "missing"), old, "example.com/a:latest"); err != nil || got {
+		t.Errorf("layoutContains(missing) = %t, %v, wanted false", got, err)
+	}
+}
+
+func TestWriteImageLayoutConcurrently(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "layout")
+	want := map[string]v1.Hash{}
+	idxs := map[string]v1.ImageIndex{}
+	for i := range 8 {
+		idx, err := random.Index(64, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := fmt.Sprintf("example.com/img%d:latest", i)
+		idxs[ref] = idx
+		if want[ref], err = idx.Digest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var errg errgroup.Group
+	for ref, idx := range idxs {
+		errg.Go(func() error { return writeImageLayout(dir, idx, ref, "") })
+	}
+	if err := errg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if got := layoutRefs(t, dir); !maps.Equal(got, want) {
+		t.Errorf("layout refs = %v, wanted %v", got, want)
+	}
+}
+
+func TestEnsureImageLayout(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	idx, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := name.NewDigest(strings.TrimPrefix(srv.URL, "http://") + "/test@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(dig, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	tags, diags := types.SetValueFrom(ctx, basetypes.StringType{}, []string{"v1"})
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	data := &BuildResourceModel{
+		ImageRef:      types.StringValue(dig.String()),
+		OciLayoutPath: types.StringValue(dir),
+		Tags:          tags,
+	}
+	ref := dig.Repository.Tag("v1").String()
+
+	check := func() {
+		t.Helper()
+		if err := data.ensureImageLayout(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := layoutContains(dir, h, ref); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("layout doesn't contain %s as %s", h, ref)
+		}
+	}
+
+	// The layout is written when there is none.
+	check()
+
+	// And again when it's been deleted, or some of it has.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := im.Manifests[0].Digest
+	if err := os.Remove(filepath.Join(dir, "blobs", m.Algorithm, m.Hex)); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// Renaming the image replaces the entry under its old name.
+	state := *data
+	data.Tags, diags = types.SetValueFrom(ctx, basetypes.StringType{}, []string{"v2"})
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if err := data.ensureImageLayout(ctx, &state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := layoutRefs(t, dir), map[string]v1.Hash{dig.Repository.Tag("v2").String(): h}; !maps.Equal(got, want) {
+		t.Errorf("layout refs = %v, wanted %v", got, want)
+	}
+
+	// Offline, a layout that has the image is left alone, while a missing
+	// image fails rather than being fetched.
+	data.popts.planOffline = true
+	if err := data.ensureImageLayout(ctx, nil); err != nil {
+		t.Errorf("ensureImageLayout(offline, present) = %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.ensureImageLayout(ctx, nil); err == nil || !strings.Contains(err.Error(), "plan_offline") {
+		t.Errorf("ensureImageLayout(offline, missing) = %v, wanted an error", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected no layout offline, got %v", err)
+	}
+}
+
+func TestHasImageLayout(t *testing.T) {
+	ctx := context.Background()
+	idx, err := random.Index(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := name.NewDigest("example.com/test@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "layout")
+	data := &BuildResourceModel{
+		ImageRef:      types.StringValue(dig.String()),
+		OciLayoutPath: types.StringValue(dir),
+		Tags:          types.SetNull(basetypes.StringType{}),
+	}
+
+	if ok, err := data.hasImageLayout(ctx); err != nil || ok {
+		t.Errorf("hasImageLayout() without a layout = %t, %v, wanted false", ok, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("hasImageLayout() created the layout: %v", err)
+	}
+	if err := writeImageLayout(dir, idx, dig.Repository.Tag("latest").String(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := data.hasImageLayout(ctx); err != nil || !ok {
+		t.Errorf("hasImageLayout() = %t, %v, wanted true", ok, err)
+	}
+}
@@ -0,0 +1,179 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// missingFiles collects the files that a build couldn't find while offline,
+// so that they can all be reported rather than just the first.
+type missingFiles struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+func (m *missingFiles) add(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.names == nil {
+		m.names = map[string]struct{}{}
+	}
+	m.names[name] = struct{}{}
+}
+
+func (m *missingFiles) list() []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.names))
+	for name := range m.names {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// wrap adds the files found missing to err, if any.
+func (m *missingFiles) wrap(err error) error {
+	names := m.list()
+	if err == nil || len(names) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w\n\n%s", err, missingError(names))
+}
+
+func missingError(names []string) error {
+	return fmt.Errorf("the provider is offline, and these files are not in the cache or offline mirror:\n  %s", strings.Join(names, "\n  "))
+}
+
+// optional reports whether a URL may be missing without failing the build.
+// apko asks repositories for their signing keys, but falls back on the
+// configured keyring when they don't say.
+func optional(u *url.URL) bool {
+	return path.Base(u.Path) == "apk-configuration"
+}
+
+// mirrorPath returns where a URL is found in an offline mirror, which is laid
+// out by host and path, as "wget --mirror" does.
+func mirrorPath(mirror string, u *url.URL) string {
+	return filepath.Join(mirror, u.Host, filepath.FromSlash(path.Clean("/"+u.Path)))
+}
+
+// available reports whether a URL can be served while offline.
+func (p ProviderOpts) available(u *url.URL) bool {
+	if p.apkCache != nil {
+		_, key := cacheKey(u)
+		if ref, ok := p.apkCache.loadRef(key); ok {
+			if _, err := os.Stat(p.apkCache.blobPath(ref.Digest)); err == nil {
+				return true
+			}
+		}
+	}
+	if p.offlineMirror != "" {
+		if fi, err := os.Stat(mirrorPath(p.offlineMirror, u)); err == nil && fi.Mode().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOffline fails fast when the provider is offline and the keys or
+// indexes needed to build ic for archs aren't available locally, listing all
+// of the files that are missing. With pinned, the packages of ic, which are
+// expected to be locked to name=version, are checked too.
+func (p ProviderOpts) checkOffline(ic *types.ImageConfiguration, archs []types.Architecture, pinned bool) error {
+	if !p.offline {
+		return nil
+	}
+
+	var repos []string
+	for _, repo := range slices.Concat(ic.Contents.Repositories, ic.Contents.BuildRepositories, p.repositories, p.buildRespositories) {
+		// Tagged repositories are written as "@tag url".
+		if strings.HasPrefix(repo, "@") {
+			if _, after, ok := strings.Cut(repo, " "); ok {
+				repo = strings.TrimSpace(after)
+			}
+		}
+		if remoteURL(repo) {
+			repos = append(repos, strings.TrimSuffix(repo, "/"))
+		}
+	}
+
+	var missing []string
+	check := func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && p.available(u)
+	}
+	for _, key := range slices.Concat(ic.Contents.Keyring, p.keyring) {
+		if remoteURL(key) && !check(key) {
+			missing = append(missing, key)
+		}
+	}
+	for _, arch := range archs {
+		for _, repo := range repos {
+			if u := repo + "/" + arch.ToAPK() + "/APKINDEX.tar.gz"; !check(u) {
+				missing = append(missing, u)
+			}
+		}
+		if !pinned || len(repos) == 0 {
+			continue
+		}
+		for _, pkg := range ic.Contents.Packages {
+			name, version, ok := strings.Cut(pkg, "=")
+			if !ok || strings.ContainsAny(name, "<>~@") || strings.ContainsAny(version, "<>~=@") {
+				// Only exact pins name an APK.
+				continue
+			}
+			found := slices.ContainsFunc(repos, func(repo string) bool {
+				return check(repo + "/" + arch.ToAPK() + "/" + name + "-" + version + ".apk")
+			})
+			if !found {
+				missing = append(missing, fmt.Sprintf("%s-%s.apk (%s)", name, version, arch.ToAPK()))
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	slices.Sort(missing)
+	return missingError(slices.Compact(missing))
+}
+
+func remoteURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// fromMirror answers req from the offline mirror, reporting false if the
+// mirror doesn't have it.
+func fromMirror(req *http.Request, mirror string) (*http.Response, bool) {
+	if mirror == "" {
+		return nil, false
+	}
+	f, err := os.Open(mirrorPath(mirror, req.URL))
+	if err != nil {
+		return nil, false
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, false
+	}
+	return serveFile(req, f, fi.Size(), ""), true
+}
+
+var errOfflineUnconfigured = errors.New("offline requires cache_dir (or " + cacheDirEnv + ") or offline_mirror to be set")
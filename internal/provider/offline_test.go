@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func TestOfflineMirror(t *testing.T) {
+	mirror := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mirror, "packages.example.com", "os", "x86_64"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mirror, "packages.example.com", "os", "x86_64", "APKINDEX.tar.gz"), []byte("index"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := &missingFiles{}
+	rt := &cacheTransport{inner: http.DefaultTransport, offline: true, mirror: mirror, missing: missing}
+	if code, body, _ := testGet(t, rt, http.MethodGet, "https://packages.example.com/os/x86_64/APKINDEX.tar.gz"); code != http.StatusOK || body != "index" {
+		t.Errorf("GET from mirror = %d %q, want 200 \"index\"", code, body)
+	}
+	for _, u := range []string{
+		"https://packages.example.com/os/x86_64/foo-1.0-r0.apk",
+		"https://packages.example.com/os/x86_64/foo-1.0-r0.apk",
+		"https://packages.example.com/os/aarch64/APKINDEX.tar.gz",
+		"https://packages.example.com/os/apk-configuration",
+	} {
+		if code, _, _ := testGet(t, rt, http.MethodGet, u); code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", u, code)
+		}
+	}
+
+	want := []string{
+		"https://packages.example.com/os/aarch64/APKINDEX.tar.gz",
+		"https://packages.example.com/os/x86_64/foo-1.0-r0.apk",
+	}
+	if got := missing.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("missing = %q, want %q", got, want)
+	}
+	if err := missing.wrap(os.ErrNotExist); err == nil || !strings.Contains(err.Error(), want[0]) {
+		t.Errorf("wrap() = %v, want it to list the missing files", err)
+	}
+}
+
+func TestCheckOffline(t *testing.T) {
+	repo := &testRepo{files: map[string]string{
+		"/os/x86_64/APKINDEX.tar.gz": "index",
+		"/os/x86_64/foo-1.0-r0.apk":  "foo",
+		"/key.rsa.pub":               "key",
+	}}
+	srv := httptest.NewServer(repo)
+	defer srv.Close()
+
+	c, err := newAPKCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path := range repo.files {
+		testGet(t, c.transport(http.DefaultTransport, false), http.MethodGet, srv.URL+path)
+	}
+
+	popts := ProviderOpts{apkCache: c, offline: true}
+	ic := &types.ImageConfiguration{Contents: types.ImageContents{
+		Repositories: []string{srv.URL + "/os", "@local /local/repo"},
+		Keyring:      []string{srv.URL + "/key.rsa.pub", srv.URL + "/other.rsa.pub"},
+		Packages:     []string{"foo=1.0-r0", "bar=2.0-r0", "baz", "qux>=1"},
+	}}
+	archs := []types.Architecture{types.ParseArchitecture("x86_64"), types.ParseArchitecture("aarch64")}
+
+	err = popts.checkOffline(ic, archs, true)
+	if err == nil {
+		t.Fatal("checkOffline() = nil, want an error")
+	}
+	for _, want := range []string{
+		srv.URL + "/other.rsa.pub",
+		srv.URL + "/os/aarch64/APKINDEX.tar.gz",
+		"bar-2.0-r0.apk (x86_64)",
+		"foo-1.0-r0.apk (aarch64)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("checkOffline() = %v, want it to list %s", err, want)
+		}
+	}
+	for _, notWant := range []string{
+		srv.URL + "/key.rsa.pub\n",
+		srv.URL + "/os/x86_64/APKINDEX.tar.gz",
+		"foo-1.0-r0.apk (x86_64)",
+		"baz",
+		"qux",
+	} {
+		if strings.Contains(err.Error()+"\n", notWant) {
+			t.Errorf("checkOffline() = %v, want it not to list %s", err, notWant)
+		}
+	}
+
+	// Locking only needs the indexes.
+	ic.Contents.Keyring = ic.Contents.Keyring[:1]
+	if err := popts.checkOffline(ic, archs[:1], false); err != nil {
+		t.Errorf("checkOffline() = %v, want nil", err)
+	}
+
+	popts.offline = false
+	if err := popts.checkOffline(ic, archs, true); err != nil {
+		t.Errorf("checkOffline() when online = %v, want nil", err)
+	}
+}
@@ -0,0 +1,218 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"chainguard.dev/apko/pkg/build"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+)
+
+type PackagePolicyConfig struct {
+	Deny     []string `tfsdk:"deny"`
+	Allow    []string `tfsdk:"allow"`
+	Required []string `tfsdk:"required"`
+}
+
+// packageName returns the name of the package or virtual that pkg, which may
+// carry a version constraint or a repository tag, refers to.
+func packageName(pkg string) string {
+	if idx := strings.IndexAny(pkg, "=<>~@"); idx >= 0 {
+		return pkg[:idx]
+	}
+	return pkg
+}
+
+// matchAny returns the first of patterns that name matches.
+func matchAny(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		// The patterns are validated by the schema.
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// violations checks the packages pkgs that make up an image against the
+// policy, explaining which of the requested packages pulled in each package
+// that the policy doesn't allow. When requested is empty, the packages that
+// nothing else in pkgs depends on are taken to be the requested ones.
+func (cfg *PackagePolicyConfig) violations(requested []string, pkgs []*apk.Package) []string {
+	if cfg == nil {
+		return nil
+	}
+
+	g := newDependencyGraph(pkgs)
+	if len(requested) == 0 {
+		requested = g.roots()
+	}
+	chains := g.chains(requested)
+
+	var out []string
+	for _, pkg := range g.pkgs {
+		var why string
+		if pattern, ok := matchAny(cfg.Deny, pkg.Name); ok {
+			why = fmt.Sprintf("is denied by %q", pattern)
+		} else if _, ok := matchAny(cfg.Allow, pkg.Name); len(cfg.Allow) != 0 && !ok {
+			why = "is not allowed by any pattern"
+		} else {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s=%s %s, %s", pkg.Name, pkg.Version, why, describeChain(chains[pkg.Name])))
+	}
+	for _, name := range cfg.Required {
+		if _, ok := g.byName[name]; !ok {
+			out = append(out, fmt.Sprintf("%s is required, but is not in the image", name))
+		}
+	}
+	return out
+}
+
+// describeChain explains how the last package of chain was pulled in by the
+// first.
+func describeChain(chain []string) string {
+	switch len(chain) {
+	case 0:
+		return "which none of the requested packages depends on"
+	case 1:
+		return "which was requested directly"
+	default:
+		return fmt.Sprintf("pulled in by %s (%s)", chain[0], strings.Join(chain, " -> "))
+	}
+}
+
+// checkPackagePolicy checks the packages installed by bc against the
+// provider's package policy.
+func (p ProviderOpts) checkPackagePolicy(bc *build.Context) error {
+	if p.packagePolicy == nil {
+		return nil
+	}
+	installed, err := bc.InstalledPackages()
+	if err != nil {
+		return fmt.Errorf("listing installed packages: %w", err)
+	}
+	pkgs := make([]*apk.Package, 0, len(installed))
+	for _, pkg := range installed {
+		pkgs = append(pkgs, &pkg.Package)
+	}
+	// The packages of the configuration are usually locked, including
+	// every dependency, so trace the offending packages back to the ones
+	// nothing else depends on instead.
+	if v := p.packagePolicy.violations(nil, pkgs); len(v) != 0 {
+		return fmt.Errorf("the %s image violates the package_policy:\n  %s", bc.Arch().ToAPK(), strings.Join(v, "\n  "))
+	}
+	return nil
+}
+
+// dependencyGraph links packages to the packages that satisfy their
+// dependencies.
+type dependencyGraph struct {
+	pkgs []*apk.Package
+	// byName maps package names, and the names they provide, to packages.
+	byName map[string]*apk.Package
+}
+
+func newDependencyGraph(pkgs []*apk.Package) *dependencyGraph {
+	g := &dependencyGraph{
+		pkgs:   slices.Clone(pkgs),
+		byName: make(map[string]*apk.Package, len(pkgs)),
+	}
+	slices.SortFunc(g.pkgs, func(a, b *apk.Package) int { return strings.Compare(a.Name, b.Name) })
+	for _, pkg := range g.pkgs {
+		g.byName[pkg.Name] = pkg
+	}
+	for _, pkg := range g.pkgs {
+		for _, p := range pkg.Provides {
+			if _, ok := g.byName[packageName(p)]; !ok {
+				g.byName[packageName(p)] = pkg
+			}
+		}
+	}
+	return g
+}
+
+// dependencies returns the packages that satisfy the dependencies of pkg.
+func (g *dependencyGraph) dependencies(pkg *apk.Package) []*apk.Package {
+	var out []*apk.Package
+	for _, dep := range pkg.Dependencies {
+		if strings.HasPrefix(dep, "!") {
+			// Conflicts pull nothing in.
+			continue
+		}
+		if d, ok := g.byName[packageName(dep)]; ok && d != pkg {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// roots returns the names of the packages that no other package depends on.
+func (g *dependencyGraph) roots() []string {
+	depended := map[*apk.Package]bool{}
+	for _, pkg := range g.pkgs {
+		for _, d := range g.dependencies(pkg) {
+			depended[d] = true
+		}
+	}
+	var out []string
+	for _, pkg := range g.pkgs {
+		if !depended[pkg] {
+			out = append(out, pkg.Name)
+		}
+	}
+	return out
+}
+
+// chains returns, by package name, the shortest chain of dependencies from
+// one of requested to each package, starting with the requested package.
+func (g *dependencyGraph) chains(requested []string) map[string][]string {
+	out := map[string][]string{}
+	var queue []*apk.Package
+	for _, name := range requested {
+		pkg, ok := g.byName[packageName(name)]
+		if !ok {
+			continue
+		}
+		if _, seen := out[pkg.Name]; !seen {
+			out[pkg.Name] = []string{pkg.Name}
+			queue = append(queue, pkg)
+		}
+	}
+	for len(queue) != 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, d := range g.dependencies(pkg) {
+			if _, seen := out[d.Name]; seen {
+				continue
+			}
+			out[d.Name] = append(slices.Clone(out[pkg.Name]), d.Name)
+			queue = append(queue, d)
+		}
+	}
+	return out
+}
+
+type globValidator struct{}
+
+var _ validator.String = globValidator{}
+
+func (v globValidator) Description(context.Context) string {
+	return `value must be a glob pattern, e.g. "busybox" or "py3-*"`
+}
+func (v globValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v globValidator) ValidateString(_ context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+	if _, err := path.Match(req.ConfigValue.ValueString(), ""); err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid glob pattern", err.Error())
+	}
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+)
+
+func TestPackagePolicyViolations(t *testing.T) {
+	pkgs := []*apk.Package{
+		{Name: "app", Version: "1.0-r0", Dependencies: []string{"so:libc.so.6", "cmd:sh", "!busybox-extras"}},
+		{Name: "glibc", Version: "2.42-r0", Provides: []string{"so:libc.so.6=6"}},
+		{Name: "bash", Version: "5.2-r0", Dependencies: []string{"busybox>=1.36"}, Provides: []string{"cmd:bash=5.2-r0"}},
+		{Name: "busybox", Version: "1.36-r0", Provides: []string{"cmd:sh=1.36-r0"}},
+		{Name: "apk-tools", Version: "2.14-r0", Dependencies: []string{"so:libc.so.6"}},
+		{Name: "tzdata", Version: "2025b-r0"},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		policy    *PackagePolicyConfig
+		requested []string
+		want      []string
+	}{{
+		name:      "no policy",
+		requested: []string{"app"},
+	}, {
+		name:      "deny",
+		policy:    &PackagePolicyConfig{Deny: []string{"busybox", "apk-*"}},
+		requested: []string{"app=1.0-r0", "apk-tools", "tzdata"},
+		want: []string{
+			`apk-tools=2.14-r0 is denied by "apk-*", which was requested directly`,
+			`busybox=1.36-r0 is denied by "busybox", pulled in by app (app -> busybox)`,
+		},
+	}, {
+		name:      "allow",
+		policy:    &PackagePolicyConfig{Allow: []string{"app", "glibc", "busybox", "apk-tools", "bash"}},
+		requested: []string{"app", "tzdata>2025"},
+		want: []string{
+			`tzdata=2025b-r0 is not allowed by any pattern, which was requested directly`,
+		},
+	}, {
+		name:      "deny over allow",
+		policy:    &PackagePolicyConfig{Allow: []string{"*"}, Deny: []string{"glibc"}},
+		requested: []string{"app"},
+		want: []string{
+			`glibc=2.42-r0 is denied by "glibc", pulled in by app (app -> glibc)`,
+		},
+	}, {
+		name:      "required",
+		policy:    &PackagePolicyConfig{Required: []string{"glibc", "ca-certificates-bundle"}},
+		requested: []string{"app"},
+		want: []string{
+			"ca-certificates-bundle is required, but is not in the image",
+		},
+	}, {
+		name:   "roots",
+		policy: &PackagePolicyConfig{Deny: []string{"busybox", "tzdata"}},
+		want: []string{
+			`busybox=1.36-r0 is denied by "busybox", pulled in by app (app -> busybox)`,
+			`tzdata=2025b-r0 is denied by "tzdata", which was requested directly`,
+		},
+	}, {
+		name:      "unreachable",
+		policy:    &PackagePolicyConfig{Deny: []string{"tzdata"}},
+		requested: []string{"app"},
+		want: []string{
+			`tzdata=2025b-r0 is denied by "tzdata", which none of the requested packages depends on`,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.violations(tc.requested, pkgs); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("violations() =\n%q\nwanted\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDependencyGraphChains(t *testing.T) {
+	g := newDependencyGraph([]*apk.Package{
+		{Name: "a", Dependencies: []string{"b", "cmd:c"}},
+		{Name: "b", Dependencies: []string{"d"}},
+		{Name: "c", Provides: []string{"cmd:c=1"}, Dependencies: []string{"d", "a"}},
+		{Name: "d"},
+	})
+	if got := g.roots(); len(got) != 0 {
+		t.Errorf("roots() = %q, wanted none", got)
+	}
+	want := map[string][]string{
+		"a": {"a"},
+		"b": {"a", "b"},
+		"c": {"a", "c"},
+		"d": {"a", "b", "d"},
+	}
+	if got := g.chains([]string{"a"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("chains() = %q, wanted %q", got, want)
+	}
+}
@@ -3,6 +3,8 @@ package provider
 import (
 	"context"
 	"maps"
+	"net/http"
+	"os"
 	"runtime/debug"
 	"time"
 
@@ -10,15 +12,23 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/v1/google"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework-validators/float64validator"
 	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/mapvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/objectvalidator"
 	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
 	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"golang.org/x/sync/semaphore"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 var _ provider.Provider = &Provider{}
@@ -32,8 +42,10 @@ type Provider struct {
 }
 
 type LayeringConfig struct {
-	Strategy string `tfsdk:"strategy"`
-	Budget   int    `tfsdk:"budget"`
+	Strategy     string       `tfsdk:"strategy"`
+	Budget       int          `tfsdk:"budget"`
+	BasePackages []string     `tfsdk:"base_packages"`
+	BaseConfig   types.Object `tfsdk:"base_config"`
 }
 
 type SizeLimitsConfig struct {
@@ -44,15 +56,29 @@ type SizeLimitsConfig struct {
 }
 
 type ProviderModel struct {
-	ExtraRepositories  []string          `tfsdk:"extra_repositories"`
-	BuildRepositories  []string          `tfsdk:"build_repositories"`
-	ExtraPackages      []string          `tfsdk:"extra_packages"`
-	ExtraKeyring       []string          `tfsdk:"extra_keyring"`
-	DefaultAnnotations map[string]string `tfsdk:"default_annotations"`
-	DefaultArchs       []string          `tfsdk:"default_archs"`
-	DefaultLayering    *LayeringConfig   `tfsdk:"default_layering"`
-	SizeLimits         *SizeLimitsConfig `tfsdk:"size_limits"`
-	PlanOffline        *bool             `tfsdk:"plan_offline"`
+	ExtraRepositories      []string                        `tfsdk:"extra_repositories"`
+	BuildRepositories      []string                        `tfsdk:"build_repositories"`
+	ExtraPackages          []string                        `tfsdk:"extra_packages"`
+	ExtraKeyring           []string                        `tfsdk:"extra_keyring"`
+	DefaultAnnotations     map[string]string               `tfsdk:"default_annotations"`
+	DefaultArchs           []string                        `tfsdk:"default_archs"`
+	DefaultLayering        *LayeringConfig                 `tfsdk:"default_layering"`
+	SizeLimits             *SizeLimitsConfig               `tfsdk:"size_limits"`
+	PackagePolicy          *PackagePolicyConfig            `tfsdk:"package_policy"`
+	PlanOffline            *bool                           `tfsdk:"plan_offline"`
+	SourceDateEpoch        *string                         `tfsdk:"source_date_epoch"`
+	CacheDir               *string                         `tfsdk:"cache_dir"`
+	CacheIndexTTL          *string                         `tfsdk:"cache_index_ttl"`
+	CacheMaxSize           *int64                          `tfsdk:"cache_max_size"`
+	Offline                *bool                           `tfsdk:"offline"`
+	OfflineMirror          *string                         `tfsdk:"offline_mirror"`
+	RepositoryMirrors      map[string]string               `tfsdk:"repository_mirrors"`
+	RepositoryAuth         map[string]RepositoryAuthConfig `tfsdk:"repository_auth"`
+	RegistryAuth           map[string]RegistryAuthConfig   `tfsdk:"registry_auth"`
+	TLS                    *TLSConfig                      `tfsdk:"tls"`
+	Retry                  *RetryConfig                    `tfsdk:"retry"`
+	MaxConcurrentBuilds    *int64                          `tfsdk:"max_concurrent_builds"`
+	MaxConcurrentDownloads *int64                          `tfsdk:"max_concurrent_downloads"`
 }
 
 type ProviderOpts struct {
@@ -60,9 +86,19 @@ type ProviderOpts struct {
 	anns                                                       map[string]string
 	layering                                                   *LayeringConfig
 	sizeLimits                                                 *SizeLimitsConfig
+	packagePolicy                                              *PackagePolicyConfig
 	cache                                                      *apk.Cache
 	ropts                                                      []remote.Option
 	planOffline                                                bool
+	sourceDateEpoch                                            *time.Time
+	apkCache                                                   *apkCache
+	offline                                                    bool
+	offlineMirror                                              string
+	repositoryMirrors                                          map[string]string
+	repositoryAuth                                             map[string]repoCredential
+	transport, registryTransport                               http.RoundTripper
+	backoff                                                    wait.Backoff
+	builds, downloads                                          *semaphore.Weighted
 }
 
 func (p *Provider) Metadata(ctx context.Context, req provider.MetadataRequest, resp *provider.MetadataResponse) {
@@ -108,10 +144,10 @@ func (p *Provider) Schema(ctx context.Context, req provider.SchemaRequest, resp
 				Optional:    true,
 				Attributes: map[string]schema.Attribute{
 					"strategy": schema.StringAttribute{
-						Description: "Layering strategy, currently only 'origin' is supported",
+						Description: "Layering strategy: 'origin' groups packages by origin, 'package' gives the largest packages a layer each, 'size-balanced' spreads packages evenly across the budget by installed size, and 'shared-base' puts the packages in base_packages in a leading layer of their own",
 						Required:    true,
 						Validators: []validator.String{
-							stringvalidator.OneOf("origin"),
+							stringvalidator.OneOf(layeringStrategies...),
 						},
 					},
 					"budget": schema.Int64Attribute{
@@ -121,12 +157,260 @@ func (p *Provider) Schema(ctx context.Context, req provider.SchemaRequest, resp
 							int64validator.AtLeast(1),
 						},
 					},
+					"base_packages": schema.ListAttribute{
+						Description: "Packages of the base image for the 'shared-base' strategy, as names or pinned as name=version",
+						Optional:    true,
+						ElementType: basetypes.StringType{},
+						Validators: []validator.List{
+							listvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("base_config")),
+						},
+					},
+					"base_config": schema.ObjectAttribute{
+						Description:    "The config of the base image for the 'shared-base' strategy, e.g. the config of its apko_config, whose packages are used as base_packages. Its packages should be locked, as they are by apko_config.",
+						Optional:       true,
+						AttributeTypes: imageConfigurationSchema.AttrTypes,
+					},
+				},
+			},
+			"cache_dir": schema.StringAttribute{
+				Description: "Directory of a persistent cache for APKINDEX, APK and key files, shared by every Terraform process that uses it. Defaults to the APKO_CACHE_DIR environment variable. When neither is set, apko's default cache is used instead.",
+				Optional:    true,
+			},
+			"cache_index_ttl": schema.StringAttribute{
+				Description: "How long cached APKINDEX and key files are used before they are revalidated against the repository, as a duration (default: 5m). APKs never change, so they are not revalidated.",
+				Optional:    true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"cache_max_size": schema.Int64Attribute{
+				Description: "Maximum size of cache_dir in bytes, beyond which the least recently used files are evicted. Unset or 0 means no limit.",
+				Optional:    true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"max_concurrent_builds": schema.Int64Attribute{
+				Description: "Maximum number of architectures built at once, across every image built by this provider. Unset means no limit.",
+				Optional:    true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"max_concurrent_downloads": schema.Int64Attribute{
+				Description: "Maximum number of APKINDEX, APK and key files downloaded at once, across every resource and data source of this provider. Unset means no limit.",
+				Optional:    true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"offline": schema.BoolAttribute{
+				Description: "Whether to resolve and build packages without network access, serving APKINDEX, APK and key files only from cache_dir and offline_mirror. Fails with a list of the files that are missing from both.",
+				Optional:    true,
+			},
+			"offline_mirror": schema.StringAttribute{
+				Description: "Directory of repository files to use when offline, laid out by host and path as `wget --mirror` does, e.g. `<offline_mirror>/packages.wolfi.dev/os/x86_64/APKINDEX.tar.gz`.",
+				Optional:    true,
+			},
+			"package_policy": schema.SingleNestedAttribute{
+				Description: "Which packages images may contain, enforced on the locked package list of apko_config and on every image built, including transitive dependencies. Violations name the requested package that pulled in each offending package.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"deny": schema.ListAttribute{
+						Description: "Glob patterns of package names that images must not contain, e.g. `busybox` or `apk-tools`. Takes precedence over allow.",
+						Optional:    true,
+						ElementType: basetypes.StringType{},
+						Validators: []validator.List{
+							listvalidator.ValueStringsAre(globValidator{}),
+						},
+					},
+					"allow": schema.ListAttribute{
+						Description: "Glob patterns of package names that images may contain. When set, images must not contain any other packages.",
+						Optional:    true,
+						ElementType: basetypes.StringType{},
+						Validators: []validator.List{
+							listvalidator.ValueStringsAre(globValidator{}),
+						},
+					},
+					"required": schema.ListAttribute{
+						Description: "Names of packages that every image must contain.",
+						Optional:    true,
+						ElementType: basetypes.StringType{},
+					},
 				},
 			},
 			"plan_offline": schema.BoolAttribute{
 				Description: "Whether to plan offline",
 				Optional:    true,
 			},
+			"source_date_epoch": schema.StringAttribute{
+				Description: "Default build date for images, as an RFC3339 timestamp or a number of seconds since the unix epoch. Overrides the build date otherwise derived from the SOURCE_DATE_EPOCH environment variable or the installed packages.",
+				Optional:    true,
+				Validators: []validator.String{
+					sourceDateEpochValidator{},
+				},
+			},
+			"registry_auth": schema.MapNestedAttribute{
+				Description: "Credentials for OCI registries, by registry host (optionally with a port), taking precedence over the default keychain, e.g. `~/.docker/config.json`.",
+				Optional:    true,
+				Sensitive:   true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"username": schema.StringAttribute{
+							Description: "Username for basic auth.",
+							Optional:    true,
+							Validators: []validator.String{
+								stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("password")),
+							},
+						},
+						"password": schema.StringAttribute{
+							Description: "Password for basic auth.",
+							Optional:    true,
+							Sensitive:   true,
+							Validators: []validator.String{
+								stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("username")),
+							},
+						},
+						"identity_token": schema.StringAttribute{
+							Description: "Identity token, exchanged with the registry for an access token.",
+							Optional:    true,
+							Sensitive:   true,
+							Validators: []validator.String{
+								stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("username"), path.MatchRelative().AtParent().AtName("docker_config")),
+							},
+						},
+						"docker_config": schema.StringAttribute{
+							Description: "Path of a docker config file, or the directory containing config.json, to read the registry's credentials from, including through credential helpers.",
+							Optional:    true,
+							Validators: []validator.String{
+								stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("username")),
+							},
+						},
+					},
+					Validators: []validator.Object{
+						objectvalidator.AtLeastOneOf(path.MatchRelative().AtName("username"), path.MatchRelative().AtName("identity_token"), path.MatchRelative().AtName("docker_config")),
+					},
+				},
+			},
+			"repository_auth": schema.MapNestedAttribute{
+				Description: "Credentials for package repositories, by host (optionally with a port). Credentials embedded in the URLs of extra_repositories, build_repositories and extra_keyring are used for hosts not listed here. Credentials are never included in configs or state, so hosts whose credentials are embedded in the repository or keyring URLs of an apko_config must be listed here.",
+				Optional:    true,
+				Sensitive:   true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"username": schema.StringAttribute{
+							Description: "Username for basic auth.",
+							Optional:    true,
+							Validators: []validator.String{
+								stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("password")),
+							},
+						},
+						"password": schema.StringAttribute{
+							Description: "Password for basic auth.",
+							Optional:    true,
+							Sensitive:   true,
+							Validators: []validator.String{
+								stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("username")),
+							},
+						},
+						"token": schema.StringAttribute{
+							Description: "Bearer token.",
+							Optional:    true,
+							Sensitive:   true,
+							Validators: []validator.String{
+								stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("username"), path.MatchRelative().AtParent().AtName("netrc")),
+							},
+						},
+						"netrc": schema.StringAttribute{
+							Description: "Path of a netrc file to read the login and password for the host from.",
+							Optional:    true,
+							Validators: []validator.String{
+								stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("username")),
+							},
+						},
+					},
+					Validators: []validator.Object{
+						objectvalidator.AtLeastOneOf(path.MatchRelative().AtName("username"), path.MatchRelative().AtName("token"), path.MatchRelative().AtName("netrc")),
+					},
+				},
+			},
+			"repository_mirrors": schema.MapAttribute{
+				Description: "Mirrors to fetch packages from, as a map from a repository URL prefix to the prefix to use in its place, e.g. `{\"https://packages.wolfi.dev/os\" = \"https://mirror.example.com/wolfi/os\"}`. The longest matching prefix is used. Configs and SBOMs keep the original URLs.",
+				Optional:    true,
+				ElementType: basetypes.StringType{},
+				Validators: []validator.Map{
+					mapvalidator.KeysAre(stringvalidator.RegexMatches(httpURLRegexp, "must be an http or https URL")),
+					mapvalidator.ValueStringsAre(stringvalidator.RegexMatches(httpURLRegexp, "must be an http or https URL")),
+				},
+			},
+			"tls": schema.SingleNestedAttribute{
+				Description: "TLS settings for connections to registries and package repositories.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"ca_bundle": schema.StringAttribute{
+						Description: "Path of a PEM bundle of CA certificates to trust, in addition to the system's.",
+						Optional:    true,
+					},
+					"client_certificate": schema.StringAttribute{
+						Description: "Path of a PEM client certificate to present, for mutual TLS.",
+						Optional:    true,
+						Validators: []validator.String{
+							stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("client_key")),
+						},
+					},
+					"client_key": schema.StringAttribute{
+						Description: "Path of the PEM private key of client_certificate.",
+						Optional:    true,
+						Validators: []validator.String{
+							stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("client_certificate")),
+						},
+					},
+					"insecure_hosts": schema.ListAttribute{
+						Description: "Hosts, optionally with a port, whose TLS certificates are not verified.",
+						Optional:    true,
+						ElementType: basetypes.StringType{},
+					},
+					"plain_http_hosts": schema.ListAttribute{
+						Description: "Hosts, optionally with a port, to connect to over plain HTTP rather than HTTPS.",
+						Optional:    true,
+						ElementType: basetypes.StringType{},
+					},
+				},
+			},
+			"retry": schema.SingleNestedAttribute{
+				Description: "How pushes to registries, and fetches of APKINDEX, APK and key files, are retried when they fail with errors that may be transient. Authentication and authorization failures, and invalid manifests, are not retried.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"attempts": schema.Int64Attribute{
+						Description: "Maximum number of attempts, including the first (default: 3).",
+						Optional:    true,
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"initial_delay": schema.StringAttribute{
+						Description: "Delay before the first retry, as a duration (default: 5s). It doubles with every retry.",
+						Optional:    true,
+						Validators: []validator.String{
+							durationValidator{},
+						},
+					},
+					"max_delay": schema.StringAttribute{
+						Description: "Maximum delay between attempts, as a duration. Unset means no limit.",
+						Optional:    true,
+						Validators: []validator.String{
+							durationValidator{},
+						},
+					},
+					"jitter": schema.Float64Attribute{
+						Description: "Fraction of each delay by which it is randomly extended, e.g. 0.5 for up to half again (default: 1.0).",
+						Optional:    true,
+						Validators: []validator.Float64{
+							float64validator.AtLeast(0),
+						},
+					},
+				},
+			},
 			"size_limits": schema.SingleNestedAttribute{
 				Description: "Size limits for APK operations to protect against decompression bombs. A value of 0 means use the default, and a value of -1 means no limit.",
 				Optional:    true,
@@ -168,12 +452,33 @@ func (p *Provider) Configure(ctx context.Context, req provider.ConfigureRequest,
 		return
 	}
 
-	kc := authn.NewMultiKeychain(google.Keychain, authn.RefreshingKeychain(authn.DefaultKeychain, 30*time.Minute))
+	rkc, err := newRegistryKeychain(data.RegistryAuth)
+	if err != nil {
+		resp.Diagnostics.AddError("Invalid registry_auth", err.Error())
+		return
+	}
+	kc := authn.NewMultiKeychain(rkc, google.Keychain, authn.RefreshingKeychain(authn.DefaultKeychain, 30*time.Minute))
 	ropts := []remote.Option{
 		remote.WithAuthFromKeychain(kc),
 		remote.WithUserAgent("terraform-provider-apko/" + p.version),
 	}
 
+	// Apply the TLS settings to both registries and package repositories.
+	var apkTransport http.RoundTripper
+	registryTransport := remote.DefaultTransport
+	if data.TLS != nil {
+		registryTransport, err = data.TLS.transport(remote.DefaultTransport)
+		if err != nil {
+			resp.Diagnostics.AddError("Invalid tls", err.Error())
+			return
+		}
+		ropts = append(ropts, remote.WithTransport(registryTransport))
+		if apkTransport, err = data.TLS.transport(http.DefaultTransport); err != nil {
+			resp.Diagnostics.AddError("Invalid tls", err.Error())
+			return
+		}
+	}
+
 	puller, err := remote.NewPuller(ropts...)
 	if err != nil {
 		resp.Diagnostics.AddError("Configure []remote.Option", err.Error())
@@ -193,19 +498,87 @@ func (p *Provider) Configure(ctx context.Context, req provider.ConfigureRequest,
 	} else {
 		layering = data.DefaultLayering
 	}
+	layering, err = layering.withBaseConfig()
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("default_layering").AtName("base_config"), "Invalid base_config", err.Error())
+		return
+	}
+
+	var sde *time.Time
+	if data.SourceDateEpoch != nil {
+		t, err := parseSourceDateEpoch(*data.SourceDateEpoch)
+		if err != nil {
+			resp.Diagnostics.AddError("Invalid source_date_epoch", err.Error())
+			return
+		}
+		sde = &t
+	}
+
+	cacheDir := os.Getenv(cacheDirEnv)
+	if data.CacheDir != nil {
+		cacheDir = *data.CacheDir
+	}
+	var ac *apkCache
+	if cacheDir != "" {
+		ttl := defaultIndexTTL
+		if data.CacheIndexTTL != nil {
+			// Validated by the schema.
+			ttl, _ = time.ParseDuration(*data.CacheIndexTTL)
+		}
+		var maxSize int64
+		if data.CacheMaxSize != nil {
+			maxSize = *data.CacheMaxSize
+		}
+		ac, err = newAPKCache(cacheDir, ttl, maxSize)
+		if err != nil {
+			resp.Diagnostics.AddError("Invalid cache_dir", err.Error())
+			return
+		}
+		if err := ac.evict(ctx); err != nil {
+			resp.Diagnostics.AddWarning("Unable to evict from cache_dir", err.Error())
+		}
+	}
+
+	offline := data.Offline != nil && *data.Offline
+	var mirror string
+	if data.OfflineMirror != nil {
+		mirror = *data.OfflineMirror
+	}
+	if offline && ac == nil && mirror == "" {
+		resp.Diagnostics.AddError("Invalid offline", errOfflineUnconfigured.Error())
+		return
+	}
+
+	repoAuth, err := resolveRepositoryAuth(data.RepositoryAuth)
+	if err != nil {
+		resp.Diagnostics.AddError("Invalid repository_auth", err.Error())
+		return
+	}
 
 	opts := &ProviderOpts{
 		// This is only for testing, so we can inject provider config
-		repositories:       append(p.repositories, data.ExtraRepositories...),
-		buildRespositories: append(p.buildRespositories, data.BuildRepositories...),
+		repositories:       liftCredentials(append(p.repositories, data.ExtraRepositories...), repoAuth),
+		buildRespositories: liftCredentials(append(p.buildRespositories, data.BuildRepositories...), repoAuth),
 		packages:           append(p.packages, data.ExtraPackages...),
-		keyring:            append(p.keyring, data.ExtraKeyring...),
+		keyring:            liftCredentials(append(p.keyring, data.ExtraKeyring...), repoAuth),
 		archs:              append(p.archs, data.DefaultArchs...),
 		anns:               combineMaps(p.anns, data.DefaultAnnotations),
 		layering:           layering,
 		sizeLimits:         data.SizeLimits,
+		packagePolicy:      data.PackagePolicy,
 		cache:              apk.NewCache(true),
 		planOffline:        data.PlanOffline != nil && *data.PlanOffline,
+		sourceDateEpoch:    sde,
+		apkCache:           ac,
+		offline:            offline,
+		offlineMirror:      mirror,
+		repositoryMirrors:  data.RepositoryMirrors,
+		repositoryAuth:     repoAuth,
+		transport:          apkTransport,
+		registryTransport:  registryTransport,
+		backoff:            data.Retry.backoff(),
+		builds:             newLimit(data.MaxConcurrentBuilds),
+		downloads:          newLimit(data.MaxConcurrentDownloads),
 		ropts:              ropts,
 	}
 
@@ -225,6 +598,8 @@ func (p *Provider) DataSources(ctx context.Context) []func() datasource.DataSour
 	return []func() datasource.DataSource{
 		NewConfigDataSource,
 		NewTagsDataSource,
+		NewCachePrefetchDataSource,
+		NewImageInspectDataSource,
 	}
 }
 
@@ -0,0 +1,340 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// progressInterval is how often the progress of a push is logged.
+var progressInterval = 10 * time.Second
+
+// publish pushes t to dig, unless the registry already has it, reporting
+// whether it pushed it. The progress of the push is logged periodically, and
+// a failure is reported as a *pushError.
+func (p ProviderOpts) publish(ctx context.Context, dig name.Digest, t remote.Taggable) (bool, error) {
+	desc, err := remote.Head(dig, append(p.ropts, remote.WithContext(ctx))...)
+	if err == nil && desc.Digest.String() == dig.DigestStr() {
+		tflog.Debug(ctx, fmt.Sprintf("%s is already present, skipping the push", dig))
+		return false, nil
+	}
+	if terr, ok := errors.AsType[*transport.Error](err); err != nil && (!ok || terr.StatusCode != http.StatusNotFound) {
+		// Let the push report any real problem with the registry.
+		tflog.Debug(ctx, fmt.Sprintf("unable to check for %s: %v", dig, err))
+	}
+
+	pp := newPushProgress(t)
+	rt := p.registryTransport
+	if rt == nil {
+		rt = remote.DefaultTransport
+	}
+	updates := make(chan v1.Update, 16)
+	pusher, err := remote.NewPusher(append(p.ropts,
+		// The provider's pusher is reused otherwise, which reports to no one.
+		remote.Reuse[*remote.Pusher](nil),
+		remote.WithTransport(&progressTransport{progress: pp, inner: rt}),
+		remote.WithProgress(updates),
+	)...)
+	if err != nil {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pp.report(ctx, dig, updates)
+	}()
+	err = retry(ctx, p.retryBackoff(), func(ctx context.Context) error {
+		return pusher.Push(ctx, dig, t)
+	})
+	close(updates)
+	<-done
+	if err != nil {
+		return false, pp.failure(err)
+	}
+	return true, nil
+}
+
+// pushProgress tracks which blobs and manifests of an index the registry has
+// while it is pushed.
+type pushProgress struct {
+	// What each blob or manifest is, and its size.
+	what  map[v1.Hash]string
+	sizes map[v1.Hash]int64
+	// The architectures that each blob or manifest belongs to.
+	archs map[v1.Hash][]string
+
+	mu              sync.Mutex
+	done            map[v1.Hash]bool
+	complete, total int64
+}
+
+func newPushProgress(t remote.Taggable) *pushProgress {
+	pp := &pushProgress{
+		what:  map[v1.Hash]string{},
+		sizes: map[v1.Hash]int64{},
+		archs: map[v1.Hash][]string{},
+		done:  map[v1.Hash]bool{},
+	}
+	idx, ok := t.(v1.ImageIndex)
+	if !ok {
+		return pp
+	}
+	if h, err := idx.Digest(); err == nil {
+		pp.what[h] = "index"
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return pp
+	}
+	for _, desc := range im.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			continue
+		}
+		arch := "unknown"
+		if desc.Platform != nil {
+			arch = desc.Platform.String()
+		}
+		pp.add(desc.Digest, "manifest", desc.Size, arch)
+		if cfg, err := img.ConfigName(); err == nil {
+			m, err := img.Manifest()
+			if err == nil {
+				pp.add(cfg, "config", m.Config.Size, arch)
+			}
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			continue
+		}
+		for _, l := range layers {
+			h, err := l.Digest()
+			if err != nil {
+				continue
+			}
+			size, err := l.Size()
+			if err != nil {
+				continue
+			}
+			pp.add(h, "layer", size, arch)
+		}
+	}
+	return pp
+}
+
+func (pp *pushProgress) add(h v1.Hash, what string, size int64, arch string) {
+	pp.what[h] = what
+	pp.sizes[h] = size
+	if !slices.Contains(pp.archs[h], arch) {
+		pp.archs[h] = append(pp.archs[h], arch)
+	}
+}
+
+// describe says which blob or manifest of the index h is.
+func (pp *pushProgress) describe(h v1.Hash) string {
+	what, ok := pp.what[h]
+	if !ok {
+		return h.String()
+	}
+	if what == "index" {
+		return "index " + h.String()
+	}
+	s := fmt.Sprintf("%s %s", what, h)
+	if what == "layer" {
+		s += " (" + byteSize(pp.sizes[h]) + ")"
+	}
+	return s + " of " + strings.Join(pp.archs[h], ", ")
+}
+
+func (pp *pushProgress) markDone(h v1.Hash) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.done[h] = true
+}
+
+// report logs the progress of the push every progressInterval until updates
+// is closed, and then once more.
+func (pp *pushProgress) report(ctx context.Context, dig name.Digest, updates <-chan v1.Update) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				tflog.Info(ctx, fmt.Sprintf("pushed %s: %s", dig, pp.summary()))
+				return
+			}
+			if u.Error == nil {
+				pp.mu.Lock()
+				pp.complete, pp.total = u.Complete, u.Total
+				pp.mu.Unlock()
+			}
+		case <-ticker.C:
+			tflog.Info(ctx, fmt.Sprintf("pushing %s: %s", dig, pp.summary()))
+		}
+	}
+}
+
+// summary describes how far along the push is, overall and by architecture.
+func (pp *pushProgress) summary() string {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	type counts struct{ done, total int }
+	byArch := map[string]*counts{}
+	var all counts
+	for h, archs := range pp.archs {
+		all.total++
+		if pp.done[h] {
+			all.done++
+		}
+		for _, arch := range archs {
+			c, ok := byArch[arch]
+			if !ok {
+				c = &counts{}
+				byArch[arch] = c
+			}
+			c.total++
+			if pp.done[h] {
+				c.done++
+			}
+		}
+	}
+
+	s := fmt.Sprintf("%s of %s uploaded", byteSize(pp.complete), byteSize(pp.total))
+	if all.total == 0 {
+		return s
+	}
+	s += fmt.Sprintf(", %d/%d blobs and manifests done", all.done, all.total)
+	var parts []string
+	for _, arch := range slices.Sorted(maps.Keys(byArch)) {
+		parts = append(parts, fmt.Sprintf("%s %d/%d", arch, byArch[arch].done, byArch[arch].total))
+	}
+	return s + " (" + strings.Join(parts, ", ") + ")"
+}
+
+// failure wraps the error of a failed push in a *pushError that says which
+// blob or manifest the registry rejected.
+func (pp *pushProgress) failure(err error) error {
+	pe := &pushError{err: err}
+	if terr, ok := errors.AsType[*transport.Error](err); ok && terr.Request != nil {
+		pe.status = terr.StatusCode
+		pe.request = terr.Request.Method + " " + terr.Request.URL.Redacted()
+		if _, h, ok := pushedObject(terr.Request); ok {
+			pe.object = pp.describe(h)
+		}
+		for _, d := range terr.Errors {
+			pe.response = append(pe.response, d.String())
+		}
+	}
+	return pe
+}
+
+// pushError is a failed push, with what the registry rejected and how.
+type pushError struct {
+	object   string
+	request  string
+	status   int
+	response []string
+	err      error
+}
+
+func (e *pushError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pushError) Unwrap() error {
+	return e.err
+}
+
+// pushDiagnostic returns the summary and detail of the diagnostic for a push
+// of dig that failed with err.
+func pushDiagnostic(dig name.Digest, err error) (string, string) {
+	pe, ok := errors.AsType[*pushError](err)
+	if !ok || pe.request == "" {
+		return "Error publishing " + dig.String(), err.Error()
+	}
+	summary := "Error pushing to " + dig.Context().String()
+	if pe.object != "" {
+		summary = fmt.Sprintf("Error pushing %s to %s", pe.object, dig.Context())
+	}
+	detail := fmt.Sprintf("The registry responded to %s with %d %s.", pe.request, pe.status, http.StatusText(pe.status))
+	if len(pe.response) != 0 {
+		detail += "\n\nRegistry response:\n  " + strings.Join(pe.response, "\n  ")
+	}
+	return summary, detail + "\n\n" + err.Error()
+}
+
+// progressTransport marks the blobs and manifests that the registry has, as
+// they are found, mounted or uploaded.
+type progressTransport struct {
+	progress *pushProgress
+	inner    http.RoundTripper
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	kind, h, ok := pushedObject(req)
+	if !ok {
+		return resp, nil
+	}
+	switch {
+	case req.Method == http.MethodHead && resp.StatusCode == http.StatusOK,
+		req.Method == http.MethodPut && resp.StatusCode == http.StatusCreated,
+		kind == "mount" && resp.StatusCode == http.StatusCreated:
+		t.progress.markDone(h)
+	}
+	return resp, nil
+}
+
+// pushedObject returns the blob or manifest a registry request is about, and
+// whether it is a blob, a blob mount or a manifest.
+func pushedObject(req *http.Request) (string, v1.Hash, bool) {
+	var kind, ref string
+	p := req.URL.Path
+	q := req.URL.Query()
+	if i := strings.LastIndex(p, "/blobs/uploads/"); i >= 0 {
+		kind, ref = "blob", q.Get("digest")
+		if m := q.Get("mount"); m != "" {
+			kind, ref = "mount", m
+		}
+	} else if i := strings.LastIndex(p, "/blobs/"); i >= 0 {
+		kind, ref = "blob", p[i+len("/blobs/"):]
+	} else if i := strings.LastIndex(p, "/manifests/"); i >= 0 {
+		kind, ref = "manifest", p[i+len("/manifests/"):]
+	}
+	h, err := v1.NewHash(ref)
+	if kind == "" || err != nil {
+		return "", v1.Hash{}, false
+	}
+	return kind, h, true
+}
+
+// byteSize formats n bytes for people.
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
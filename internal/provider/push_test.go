@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	reg := registry.New()
+	var writes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writes.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	idx, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := name.NewDigest(strings.TrimPrefix(srv.URL, "http://") + "/test@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var popts ProviderOpts
+	pushed, err := popts.publish(ctx, dig, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pushed {
+		t.Error("expected the first publish to push")
+	}
+	if writes.Load() == 0 {
+		t.Error("expected the first publish to write to the registry")
+	}
+
+	// Publishing the same digest again doesn't write anything.
+	writes.Store(0)
+	pushed, err = popts.publish(ctx, dig, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed {
+		t.Error("expected the second publish to find the image already present")
+	}
+	if n := writes.Load(); n != 0 {
+		t.Errorf("the second publish made %d writes, wanted 0", n)
+	}
+}
+
+func TestPublishProgress(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	idx, err := random.Index(1024, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := name.NewDigest(strings.TrimPrefix(srv.URL, "http://") + "/test@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 manifests, 2 configs and 4 layers, of images without a platform.
+	pp := newPushProgress(idx)
+	if got, want := pp.summary(), "0 B of 0 B uploaded, 0/8 blobs and manifests done (unknown 0/8)"; got != want {
+		t.Errorf("summary() = %q, wanted %q", got, want)
+	}
+
+	var popts ProviderOpts
+	pusher, err := remote.NewPusher(remote.WithTransport(&progressTransport{progress: pp, inner: remote.DefaultTransport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pusher.Push(ctx, dig, idx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pp.summary(), "0 B of 0 B uploaded, 8/8 blobs and manifests done (unknown 8/8)"; got != want {
+		t.Errorf("summary() = %q, wanted %q", got, want)
+	}
+	if pushed, err := popts.publish(ctx, dig, idx); err != nil || pushed {
+		t.Errorf("publish() = %v, %v, wanted the image to be present", pushed, err)
+	}
+}
+
+func TestPushDiagnostic(t *testing.T) {
+	ctx := context.Background()
+	reg := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"MANIFEST_INVALID","message":"manifest invalid"}]}`))
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	idx, err := random.Index(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig, err := name.NewDigest(strings.TrimPrefix(srv.URL, "http://") + "/test@" + h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var popts ProviderOpts
+	_, err = popts.publish(ctx, dig, idx)
+	if err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	summary, detail := pushDiagnostic(dig, err)
+	if !strings.HasPrefix(summary, "Error pushing manifest sha256:") || !strings.HasSuffix(summary, " of unknown to "+dig.Context().String()) {
+		t.Errorf("summary = %q", summary)
+	}
+	for _, want := range []string{"PUT " + srv.URL + "/v2/test/manifests/sha256:", "400 Bad Request", "MANIFEST_INVALID: manifest invalid"} {
+		if !strings.Contains(detail, want) {
+			t.Errorf("detail %q does not contain %q", detail, want)
+		}
+	}
+
+	// Other errors are reported as they are.
+	summary, detail = pushDiagnostic(dig, errors.New("boom"))
+	if summary != "Error publishing "+dig.String() || detail != "boom" {
+		t.Errorf("pushDiagnostic() = %q, %q", summary, detail)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.0 KiB",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 30:         "3.0 GiB",
+	} {
+		if got := byteSize(n); got != want {
+			t.Errorf("byteSize(%d) = %q, wanted %q", n, got, want)
+		}
+	}
+}
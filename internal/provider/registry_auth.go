@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+type RegistryAuthConfig struct {
+	Username      *string `tfsdk:"username"`
+	Password      *string `tfsdk:"password"`
+	IdentityToken *string `tfsdk:"identity_token"`
+	DockerConfig  *string `tfsdk:"docker_config"`
+}
+
+// registryKeychain resolves the credentials configured by registry_auth. It
+// is anonymous for other registries, so that a multi-keychain falls back on
+// the default keychains for them.
+type registryKeychain struct {
+	auths   map[string]authn.Authenticator
+	configs map[string]*configfile.ConfigFile
+}
+
+var _ authn.Keychain = (*registryKeychain)(nil)
+
+func newRegistryKeychain(cfg map[string]RegistryAuthConfig) (*registryKeychain, error) {
+	kc := &registryKeychain{
+		auths:   map[string]authn.Authenticator{},
+		configs: map[string]*configfile.ConfigFile{},
+	}
+	for key, c := range cfg {
+		reg, err := name.NewRegistry(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		switch {
+		case c.IdentityToken != nil:
+			kc.auths[reg.RegistryStr()] = authn.FromConfig(authn.AuthConfig{IdentityToken: *c.IdentityToken})
+		case c.Username != nil:
+			var password string
+			if c.Password != nil {
+				password = *c.Password
+			}
+			kc.auths[reg.RegistryStr()] = authn.FromConfig(authn.AuthConfig{Username: *c.Username, Password: password})
+		case c.DockerConfig != nil:
+			cf, err := loadDockerConfig(*c.DockerConfig)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			kc.configs[reg.RegistryStr()] = cf
+		default:
+			return nil, fmt.Errorf("%s: one of username, identity_token or docker_config must be set", key)
+		}
+	}
+	return kc, nil
+}
+
+// loadDockerConfig reads a docker config file, given either as the file or
+// the directory containing config.json.
+func loadDockerConfig(p string) (*configfile.ConfigFile, error) {
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		p = filepath.Join(p, config.ConfigFileName)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("reading docker config: %w", err)
+	}
+	defer f.Close()
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing docker config %s: %w", p, err)
+	}
+	// Credential helpers store credentials next to the config file.
+	cf.Filename = p
+	return cf, nil
+}
+
+func (kc *registryKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	reg := target.RegistryStr()
+	if auth, ok := kc.auths[reg]; ok {
+		return auth, nil
+	}
+	cf, ok := kc.configs[reg]
+	if !ok {
+		return authn.Anonymous, nil
+	}
+
+	// This looks up credentials the same way as authn.DefaultKeychain.
+	for _, key := range []string{target.String(), reg} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Username == "" && cfg.Password == "" && cfg.Auth == "" && cfg.IdentityToken == "" && cfg.RegistryToken == "" {
+			continue
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}), nil
+	}
+	return authn.Anonymous, nil
+}
@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestRegistryKeychain(t *testing.T) {
+	dir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("carol:docker-secret"))
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths": {"registry.example.com": {"auth": "`+auth+`"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	str := func(s string) *string { return &s }
+	kc, err := newRegistryKeychain(map[string]RegistryAuthConfig{
+		"ghcr.io":              {Username: str("alice"), Password: str("s3cret")},
+		"docker.io":            {IdentityToken: str("id-token")},
+		"registry.example.com": {DockerConfig: str(dir)},
+		"other.example.com":    {DockerConfig: str(filepath.Join(dir, "config.json"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ref  string
+		want authn.AuthConfig
+	}{
+		{"ghcr.io/org/image", authn.AuthConfig{Username: "alice", Password: "s3cret"}},
+		{"ubuntu", authn.AuthConfig{IdentityToken: "id-token"}},
+		{"registry.example.com/image", authn.AuthConfig{Username: "carol", Password: "docker-secret"}},
+		// The docker config has nothing for this registry.
+		{"other.example.com/image", authn.AuthConfig{}},
+		{"gcr.io/project/image", authn.AuthConfig{}},
+	} {
+		ref, err := name.ParseReference(tc.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := kc.Resolve(ref.Context())
+		if err != nil {
+			t.Fatalf("Resolve(%s) = %v", tc.ref, err)
+		}
+		if tc.want == (authn.AuthConfig{}) {
+			if a != authn.Anonymous {
+				t.Errorf("Resolve(%s) = %v, want anonymous", tc.ref, a)
+			}
+			continue
+		}
+		got, err := a.Authorization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != tc.want {
+			t.Errorf("Resolve(%s) = %+v, want %+v", tc.ref, *got, tc.want)
+		}
+	}
+
+	if _, err := newRegistryKeychain(map[string]RegistryAuthConfig{"example.com": {DockerConfig: str(filepath.Join(dir, "missing.json"))}}); err == nil {
+		t.Error("newRegistryKeychain() with a missing docker config = nil, want an error")
+	}
+}
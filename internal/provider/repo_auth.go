@@ -0,0 +1,234 @@
+package provider
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	apkotypes "chainguard.dev/apko/pkg/build/types"
+)
+
+type RepositoryAuthConfig struct {
+	Username *string `tfsdk:"username"`
+	Password *string `tfsdk:"password"`
+	Token    *string `tfsdk:"token"`
+	Netrc    *string `tfsdk:"netrc"`
+}
+
+// repoCredential is how requests to a repository host are authenticated,
+// with either basic auth or a bearer token.
+type repoCredential struct {
+	username, password, token string
+}
+
+func (c repoCredential) apply(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// resolveRepositoryAuth turns the repository_auth blocks into credentials by
+// host, reading them from netrc files where configured.
+func resolveRepositoryAuth(cfg map[string]RepositoryAuthConfig) (map[string]repoCredential, error) {
+	creds := make(map[string]repoCredential, len(cfg))
+	for host, c := range cfg {
+		switch {
+		case c.Token != nil:
+			creds[host] = repoCredential{token: *c.Token}
+		case c.Username != nil:
+			var password string
+			if c.Password != nil {
+				password = *c.Password
+			}
+			creds[host] = repoCredential{username: *c.Username, password: password}
+		case c.Netrc != nil:
+			cred, err := readNetrc(*c.Netrc, host)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", host, err)
+			}
+			creds[host] = cred
+		default:
+			return nil, fmt.Errorf("%s: one of username, token or netrc must be set", host)
+		}
+	}
+	return creds, nil
+}
+
+// readNetrc finds the login and password for host in a netrc file, falling
+// back on its default entry.
+func readNetrc(name, host string) (repoCredential, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return repoCredential{}, fmt.Errorf("reading netrc: %w", err)
+	}
+	defer f.Close()
+
+	hostname := host
+	if u, err := url.Parse("//" + host); err == nil {
+		hostname = u.Hostname()
+	}
+
+	type entry struct {
+		login, password string
+	}
+	var (
+		machines = map[string]*entry{}
+		fallback *entry
+		current  *entry
+		macdef   bool
+	)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if macdef {
+			// Macro definitions run until a blank line.
+			macdef = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				current = &entry{}
+				machines[next()] = current
+			case "default":
+				current = &entry{}
+				fallback = current
+			case "login":
+				if current != nil {
+					current.login = next()
+				}
+			case "password":
+				if current != nil {
+					current.password = next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				next()
+				macdef = true
+				i = len(fields)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return repoCredential{}, fmt.Errorf("reading netrc: %w", err)
+	}
+
+	e := machines[host]
+	if e == nil {
+		e = machines[hostname]
+	}
+	if e == nil {
+		e = fallback
+	}
+	if e == nil {
+		return repoCredential{}, fmt.Errorf("no entry for %s in %s", hostname, name)
+	}
+	return repoCredential{username: e.login, password: e.password}, nil
+}
+
+// authTransport adds the configured credentials to requests by host.
+type authTransport struct {
+	creds map[string]repoCredential
+	inner http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cred, ok := t.creds[req.URL.Host]
+	if !ok {
+		cred, ok = t.creds[req.URL.Hostname()]
+	}
+	if !ok {
+		return t.inner.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.User = nil
+	cred.apply(req)
+	return t.inner.RoundTrip(req)
+}
+
+// liftCredentials removes the credentials embedded in repository or key
+// URLs, adding them to creds for hosts that don't have any configured, so
+// that they are used to fetch but never persisted.
+func liftCredentials(urls []string, creds map[string]repoCredential) []string {
+	if urls == nil {
+		return nil
+	}
+	out := make([]string, 0, len(urls))
+	for _, s := range urls {
+		tag, raw, tagged := strings.Cut(s, " ")
+		if !tagged || !strings.HasPrefix(tag, "@") {
+			tag, raw, tagged = "", s, false
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.User == nil {
+			out = append(out, s)
+			continue
+		}
+		if _, ok := creds[u.Host]; !ok {
+			password, _ := u.User.Password()
+			creds[u.Host] = repoCredential{username: u.User.Username(), password: password}
+		}
+		u.User = nil
+		if tagged {
+			out = append(out, tag+" "+u.String())
+		} else {
+			out = append(out, u.String())
+		}
+	}
+	return out
+}
+
+// stripCredentials removes credentials embedded in the repository and key
+// URLs of ic, so that they don't end up in state.
+func stripCredentials(ic *apkotypes.ImageConfiguration) {
+	discard := map[string]repoCredential{}
+	ic.Contents.Repositories = liftCredentials(ic.Contents.Repositories, discard)
+	ic.Contents.BuildRepositories = liftCredentials(ic.Contents.BuildRepositories, discard)
+	ic.Contents.RuntimeOnlyRepositories = liftCredentials(ic.Contents.RuntimeOnlyRepositories, discard)
+	ic.Contents.Keyring = liftCredentials(ic.Contents.Keyring, discard)
+}
+
+// checkEmbeddedCredentials fails when the repository and key URLs of ic
+// embed credentials for hosts that the provider has none for. Those are
+// stripped before the config is stored, and apko_build builds from the stored
+// config, usually in another run of the provider, so it couldn't fetch from
+// the hosts.
+func (p ProviderOpts) checkEmbeddedCredentials(ic apkotypes.ImageConfiguration) error {
+	embedded := map[string]repoCredential{}
+	for _, urls := range [][]string{ic.Contents.Repositories, ic.Contents.BuildRepositories, ic.Contents.RuntimeOnlyRepositories, ic.Contents.Keyring} {
+		liftCredentials(urls, embedded)
+	}
+	var hosts []string
+	for host := range embedded {
+		if _, ok := p.repositoryAuth[host]; ok {
+			continue
+		}
+		if u, err := url.Parse("//" + host); err == nil {
+			if _, ok := p.repositoryAuth[u.Hostname()]; ok {
+				continue
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	slices.Sort(hosts)
+	return fmt.Errorf("the repository or keyring URLs embed credentials for %s, which are not kept in the config so that they never reach state, "+
+		"so apko_build would fetch from them unauthenticated; move the credentials into the provider's repository_auth instead", strings.Join(hosts, ", "))
+}
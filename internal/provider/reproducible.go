@@ -0,0 +1,241 @@
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/oci"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+)
+
+// maxReportedFiles bounds how many differing files are listed per layer, so
+// that a wildly different rebuild doesn't produce an unreadable diagnostic.
+const maxReportedFiles = 50
+
+// verifyReproducible builds the image again with bc, which must be configured
+// like the context that produced img but with its own temporary directory,
+// and returns an error describing how the two builds differ if their digests
+// don't match.
+func verifyReproducible(ctx context.Context, bc *build.Context, lr *layerer, bopts buildOptions, img v1.Image) error {
+	dir, err := os.MkdirTemp("", "apko-verify-layers-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	layers, err := lr.buildLayers(ctx, bc, dir)
+	if err != nil {
+		return fmt.Errorf("rebuilding layers: %w", err)
+	}
+	bde, err := bopts.buildDateEpoch(bc)
+	if err != nil {
+		return fmt.Errorf("failed to determine build date epoch: %w", err)
+	}
+	rebuilt, err := oci.BuildImageFromLayers(ctx, empty.Image, layers, bc.ImageConfiguration(), bde, bc.Arch())
+	if err != nil {
+		return fmt.Errorf("failed to rebuild OCI image: %w", err)
+	}
+
+	want, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	got, err := rebuilt.Digest()
+	if err != nil {
+		return err
+	}
+	if want == got {
+		return nil
+	}
+
+	report, err := diffImages(img, rebuilt)
+	if err != nil {
+		return fmt.Errorf("build is not reproducible (%s != %s), and diffing the builds failed: %w", want, got, err)
+	}
+	return fmt.Errorf("build is not reproducible (%s != %s):\n%s", want, got, report)
+}
+
+// diffImages describes how two images differ, layer by layer and file by file.
+func diffImages(a, b v1.Image) (string, error) {
+	var sb strings.Builder
+
+	ca, err := a.ConfigFile()
+	if err != nil {
+		return "", err
+	}
+	cb, err := b.ConfigFile()
+	if err != nil {
+		return "", err
+	}
+	// The layers are compared below, so leave their diff IDs out of this.
+	if diff := cmp.Diff(ca, cb, cmpopts.IgnoreFields(v1.ConfigFile{}, "RootFS")); diff != "" {
+		fmt.Fprintf(&sb, "config (-first +second):\n%s", diff)
+	}
+
+	la, err := a.Layers()
+	if err != nil {
+		return "", err
+	}
+	lb, err := b.Layers()
+	if err != nil {
+		return "", err
+	}
+	if len(la) != len(lb) {
+		fmt.Fprintf(&sb, "layer count: %d != %d\n", len(la), len(lb))
+	}
+
+	for i := range max(len(la), len(lb)) {
+		switch {
+		case i >= len(lb):
+			d, err := la[i].Digest()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&sb, "layer %d: only in first build (%s)\n", i, d)
+			continue
+		case i >= len(la):
+			d, err := lb[i].Digest()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&sb, "layer %d: only in second build (%s)\n", i, d)
+			continue
+		}
+
+		da, err := la[i].DiffID()
+		if err != nil {
+			return "", err
+		}
+		db, err := lb[i].DiffID()
+		if err != nil {
+			return "", err
+		}
+		if da == db {
+			continue
+		}
+		fmt.Fprintf(&sb, "layer %d: %s != %s\n", i, da, db)
+
+		fa, err := layerFiles(la[i])
+		if err != nil {
+			return "", fmt.Errorf("reading layer %d: %w", i, err)
+		}
+		fb, err := layerFiles(lb[i])
+		if err != nil {
+			return "", fmt.Errorf("reading layer %d: %w", i, err)
+		}
+
+		var lines []string
+		for _, name := range slices.Sorted(maps.Keys(fa)) {
+			other, ok := fb[name]
+			if !ok {
+				lines = append(lines, fmt.Sprintf("  - %s", name))
+			} else if diff := fa[name].diff(other); diff != "" {
+				lines = append(lines, fmt.Sprintf("  ~ %s: %s", name, diff))
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(fb)) {
+			if _, ok := fa[name]; !ok {
+				lines = append(lines, fmt.Sprintf("  + %s", name))
+			}
+		}
+		if len(lines) == 0 {
+			// Same files, so the entries must be ordered differently.
+			lines = append(lines, "  (same files, different tar entry order or encoding)")
+		}
+		if len(lines) > maxReportedFiles {
+			lines = append(lines[:maxReportedFiles], fmt.Sprintf("  ... and %d more", len(lines)-maxReportedFiles))
+		}
+		sb.WriteString(strings.Join(lines, "\n"))
+		sb.WriteString("\n")
+	}
+
+	return sb.String(), nil
+}
+
+// fileEntry captures the parts of a tar entry that affect a layer's digest.
+type fileEntry struct {
+	typeflag byte
+	mode     int64
+	uid, gid int
+	size     int64
+	modTime  time.Time
+	linkname string
+	sha256   string
+}
+
+// diff lists the fields that differ between two entries for the same path.
+func (f fileEntry) diff(other fileEntry) string {
+	var parts []string
+	if f.typeflag != other.typeflag {
+		parts = append(parts, fmt.Sprintf("type %q != %q", f.typeflag, other.typeflag))
+	}
+	if f.mode != other.mode {
+		parts = append(parts, fmt.Sprintf("mode %o != %o", f.mode, other.mode))
+	}
+	if f.uid != other.uid || f.gid != other.gid {
+		parts = append(parts, fmt.Sprintf("owner %d:%d != %d:%d", f.uid, f.gid, other.uid, other.gid))
+	}
+	if f.size != other.size {
+		parts = append(parts, fmt.Sprintf("size %d != %d", f.size, other.size))
+	}
+	if !f.modTime.Equal(other.modTime) {
+		parts = append(parts, fmt.Sprintf("mtime %s != %s", f.modTime.UTC().Format(time.RFC3339), other.modTime.UTC().Format(time.RFC3339)))
+	}
+	if f.linkname != other.linkname {
+		parts = append(parts, fmt.Sprintf("link %q != %q", f.linkname, other.linkname))
+	}
+	if f.sha256 != other.sha256 {
+		parts = append(parts, "content differs")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// layerFiles indexes the entries of an uncompressed layer by path.
+func layerFiles(l v1.Layer) (map[string]fileEntry, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	files := map[string]fileEntry{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+		files[hdr.Name] = fileEntry{
+			typeflag: hdr.Typeflag,
+			mode:     hdr.Mode,
+			uid:      hdr.Uid,
+			gid:      hdr.Gid,
+			size:     hdr.Size,
+			modTime:  hdr.ModTime,
+			linkname: hdr.Linkname,
+			sha256:   hex.EncodeToString(h.Sum(nil)),
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+type testFile struct {
+	name    string
+	content string
+	mode    int64
+	modTime time.Time
+}
+
+func testLayer(t *testing.T, files ...testFile) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Typeflag: tar.TypeReg,
+			Mode:     f.mode,
+			Size:     int64(len(f.content)),
+			ModTime:  f.modTime,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func testImage(t *testing.T, layers ...v1.Layer) v1.Image {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestDiffImages(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	later := time.Unix(1700000000, 0)
+
+	base := testLayer(t, testFile{name: "etc/os-release", content: "wolfi", mode: 0o644, modTime: epoch})
+
+	a := testImage(t, base, testLayer(t,
+		testFile{name: "usr/bin/foo", content: "foo", mode: 0o755, modTime: epoch},
+		testFile{name: "usr/bin/bar", content: "bar", mode: 0o755, modTime: epoch},
+		testFile{name: "usr/bin/gone", content: "gone", mode: 0o755, modTime: epoch},
+	))
+	b := testImage(t, base, testLayer(t,
+		testFile{name: "usr/bin/foo", content: "foo", mode: 0o755, modTime: later},
+		testFile{name: "usr/bin/bar", content: "baz", mode: 0o700, modTime: epoch},
+		testFile{name: "usr/bin/new", content: "new", mode: 0o755, modTime: epoch},
+	))
+
+	report, err := diffImages(a, b)
+	if err != nil {
+		t.Fatalf("diffImages() = %v", err)
+	}
+	t.Log(report)
+
+	for _, want := range []string{
+		"layer 1: sha256:",
+		"~ usr/bin/foo: mtime 1970-01-01T00:00:00Z != 2023-11-14T22:13:20Z",
+		"~ usr/bin/bar: mode 755 != 700, content differs",
+		"- usr/bin/gone",
+		"+ usr/bin/new",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q", want)
+		}
+	}
+	if strings.Contains(report, "layer 0:") {
+		t.Errorf("report mentions identical layer 0")
+	}
+}
+
+func TestDiffImagesLayerCount(t *testing.T) {
+	l := testLayer(t, testFile{name: "a", content: "a", mode: 0o644})
+	extra := testLayer(t, testFile{name: "b", content: "b", mode: 0o644})
+
+	report, err := diffImages(testImage(t, l), testImage(t, l, extra))
+	if err != nil {
+		t.Fatalf("diffImages() = %v", err)
+	}
+	for _, want := range []string{
+		"layer count: 1 != 2",
+		"layer 1: only in second build",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+}
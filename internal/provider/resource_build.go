@@ -2,18 +2,26 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"slices"
 
 	"github.com/chainguard-dev/terraform-provider-oci/pkg/validators"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/objectvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/setvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
-	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
-	"github.com/hashicorp/terraform-plugin-framework/resource/schema/objectplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
@@ -23,8 +31,10 @@ import (
 )
 
 var (
-	_ resource.Resource                = &BuildResource{}
-	_ resource.ResourceWithImportState = &BuildResource{}
+	_ resource.Resource                   = &BuildResource{}
+	_ resource.ResourceWithImportState    = &BuildResource{}
+	_ resource.ResourceWithValidateConfig = &BuildResource{}
+	_ resource.ResourceWithModifyPlan     = &BuildResource{}
 )
 
 func NewBuildResource() resource.Resource {
@@ -41,8 +51,29 @@ type BuildResourceModel struct {
 	Config        types.Object `tfsdk:"config"`
 	Configs       types.Map    `tfsdk:"configs"`
 	ImageRef      types.String `tfsdk:"image_ref"`
+	Pushed        types.Bool   `tfsdk:"pushed"`
 	OciLayoutPath types.String `tfsdk:"oci_layout_path"`
 
+	ImageTarballsDir types.String `tfsdk:"image_tarballs_dir"`
+	ImageTarballs    types.Map    `tfsdk:"image_tarballs"`
+
+	RootFSPath types.String `tfsdk:"rootfs_path"`
+	RootFSArch types.String `tfsdk:"rootfs_arch"`
+
+	Tags                types.Set  `tfsdk:"tags"`
+	DeleteTagsOnDestroy types.Bool `tfsdk:"delete_tags_on_destroy"`
+	MirrorRepos         types.List `tfsdk:"mirror_repos"`
+	MirrorRefs          types.Map  `tfsdk:"mirror_refs"`
+
+	VerifyReproducible types.Bool   `tfsdk:"verify_reproducible"`
+	SourceDateEpoch    types.String `tfsdk:"source_date_epoch"`
+	BuildDate          types.String `tfsdk:"build_date"`
+	BaseLayersFrom     types.Object `tfsdk:"base_layers_from"`
+
+	MaxCompressedSize   types.Int64 `tfsdk:"max_compressed_size"`
+	MaxUncompressedSize types.Int64 `tfsdk:"max_uncompressed_size"`
+	ImageSizes          types.Map   `tfsdk:"image_sizes"`
+
 	SBOMs types.Map `tfsdk:"sboms"`
 
 	popts ProviderOpts // Data passed from the provider.
@@ -100,9 +131,8 @@ func (r *BuildResource) Schema(ctx context.Context, req resource.SchemaRequest,
 				MarkdownDescription: "The parsed structure of the apko configuration.",
 				Required:            true,
 				AttributeTypes:      imageConfigurationSchema.AttrTypes,
-				PlanModifiers: []planmodifier.Object{
-					objectplanmodifier.RequiresReplace(),
-				},
+				// Changes only require replacement when they change the
+				// resulting digest, see ModifyPlan.
 			},
 			"configs": schema.MapNestedAttribute{
 				MarkdownDescription: "A map from the APK architecture to the config for that architecture.",
@@ -118,18 +148,124 @@ func (r *BuildResource) Schema(ctx context.Context, req resource.SchemaRequest,
 						},
 					},
 				},
-				PlanModifiers: []planmodifier.Map{
-					mapplanmodifier.RequiresReplace(),
-				},
+				// Changes only require replacement when they change the
+				// resulting digest, see ModifyPlan.
 			},
 			"image_ref": schema.StringAttribute{
 				MarkdownDescription: "The resulting fully-qualified digest (e.g. {repo}@sha256:deadbeef).",
 				Computed:            true,
 			},
+			"pushed": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image was pushed when it was published, rather than found to be already present in the registry.",
+				Computed:            true,
+			},
 			"oci_layout_path": schema.StringAttribute{
-				MarkdownDescription: "Optional local filesystem path to write an OCI image layout of the built image. When set, the layout is written to this path after the build (creating the directory if needed). The caller owns the directory lifecycle. Leave unset to skip the layout write.",
+				MarkdownDescription: "Optional local filesystem path to write an OCI image layout of the built image. When set, the image index is added to the layout at this path after the build (creating the layout if needed), annotated with an `org.opencontainers.image.ref.name` of the first of `tags` in `repo`, or `latest`. The image previously written under that name, or under the name the image had before `tags` changed, is replaced, and other images in the layout are left alone. Resources that share a layout take turns updating it. If the image is missing from the layout on refresh, the plan updates the resource to write it again. The caller owns the directory lifecycle. Leave unset to skip the layout write.",
+				Optional:            true,
+			},
+			"tags": schema.SetAttribute{
+				MarkdownDescription: "Tags in `repo` to point at the image once it is published. Tags that are moved to other images outside of Terraform are detected on refresh and pointed back at the image.",
+				Optional:            true,
+				ElementType:         basetypes.StringType{},
+				Validators: []validator.Set{
+					setvalidator.ValueStringsAre(stringvalidator.RegexMatches(tagRegexp, "must be a valid tag")),
+				},
+			},
+			"delete_tags_on_destroy": schema.BoolAttribute{
+				MarkdownDescription: "When true, `tags` that still point at the image are deleted from the registry when the resource is destroyed, or when they are removed from `tags`. Not every registry supports deleting tags.",
 				Optional:            true,
 			},
+			"mirror_repos": schema.ListAttribute{
+				MarkdownDescription: "Additional container repositories, e.g. in other registries, to which the image is published by copying it from `repo`, rather than building it again. Registries that support cross-repository blob mounts don't have the blobs uploaded again.",
+				Optional:            true,
+				ElementType:         basetypes.StringType{},
+				Validators: []validator.List{
+					listvalidator.ValueStringsAre(validators.RepoValidator{}),
+					listvalidator.UniqueValues(),
+				},
+			},
+			"mirror_refs": schema.MapAttribute{
+				MarkdownDescription: "A map from each of `mirror_repos` to the fully-qualified digest of the image in it.",
+				Computed:            true,
+				ElementType:         basetypes.StringType{},
+			},
+			"image_tarballs_dir": schema.StringAttribute{
+				MarkdownDescription: "Optional local directory to write a docker-archive tarball of the image of each architecture to, as `<arch>.tar` with the APK architecture, e.g. for `docker load` or scanners. The tarballs are tagged with the first of `tags` in `repo`, or `latest`. The caller owns the directory lifecycle.",
+				Optional:            true,
+			},
+			"rootfs_path": schema.StringAttribute{
+				MarkdownDescription: "Optional local path to write the flattened root filesystem of the image of `rootfs_arch` to, e.g. for structure tests or license scanners. It is written as a tar file if the path ends in `.tar`, and as a directory otherwise, replacing the root filesystem written there before. The ownership, permissions and extended attributes of each file are recorded in `<rootfs_path>.manifest.json`, as a directory only has them when Terraform runs as root, and device nodes are only recorded there. The caller owns the lifecycle of both.",
+				Optional:            true,
+			},
+			"rootfs_arch": schema.StringAttribute{
+				MarkdownDescription: "The architecture whose root filesystem is written to `rootfs_path`. Defaults to the only architecture of the image, or else the architecture Terraform runs on.",
+				Optional:            true,
+				Validators: []validator.String{
+					stringvalidator.LengthAtLeast(1),
+				},
+			},
+			"image_tarballs": schema.MapNestedAttribute{
+				MarkdownDescription: "A map from the architecture to the tarball written to `image_tarballs_dir` for it.",
+				Computed:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"path": schema.StringAttribute{
+							MarkdownDescription: "The path of the tarball.",
+							Computed:            true,
+						},
+						"sha256": schema.StringAttribute{
+							MarkdownDescription: "The hex-encoded SHA256 hash of the tarball.",
+							Computed:            true,
+						},
+					},
+				},
+			},
+			"verify_reproducible": schema.BoolAttribute{
+				MarkdownDescription: "When true, each architecture is built twice in independent temporary directories, and the build fails with a layer-by-layer, file-by-file report of the differences if the resulting digests don't match.",
+				Optional:            true,
+			},
+			"source_date_epoch": schema.StringAttribute{
+				MarkdownDescription: "The build date for the image and its index, as an RFC3339 timestamp or a number of seconds since the unix epoch. Overrides the provider's `source_date_epoch`, the `SOURCE_DATE_EPOCH` environment variable, and the build date derived from the installed packages. Per-architecture SBOMs still record the newest package build date when it is later.",
+				Optional:            true,
+				Validators:          []validator.String{sourceDateEpochValidator{}},
+			},
+			"build_date": schema.StringAttribute{
+				MarkdownDescription: "The RFC3339 build date recorded on the resulting index.",
+				Computed:            true,
+			},
+			"base_layers_from": schema.SingleNestedAttribute{
+				MarkdownDescription: "Another image whose packages this image shares. The packages installed in both at the same version are placed in an identical leading layer, so that registries deduplicate it and pulls hit the cache across images built on the same base. This overrides the layering strategy with 'shared-base', keeping the configured budget, or a budget of 2 if there is none.",
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"config": schema.ObjectAttribute{
+						MarkdownDescription: "The config of the base image, e.g. the `config` of another `apko_build`. Its packages should be locked, as they are by `apko_config`.",
+						Optional:            true,
+						AttributeTypes:      imageConfigurationSchema.AttrTypes,
+						Validators: []validator.Object{
+							objectvalidator.ExactlyOneOf(path.MatchRelative().AtParent().AtName("image_ref")),
+						},
+					},
+					"image_ref": schema.StringAttribute{
+						MarkdownDescription: "A reference to the base image, e.g. the `image_ref` of another `apko_build`, whose packages are read for each architecture from an SBOM attached to the image, or otherwise from its layers, which are downloaded on every plan and apply.",
+						Optional:            true,
+					},
+				},
+			},
+			"max_compressed_size": schema.Int64Attribute{
+				MarkdownDescription: maxCompressedSizeDescription,
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"max_uncompressed_size": schema.Int64Attribute{
+				MarkdownDescription: maxUncompressedSizeDescription,
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"image_sizes": imageSizesAttribute,
 			"sboms": schema.MapNestedAttribute{
 				MarkdownDescription: "A map from the APK architecture to the digest for that architecture and its SBOM.",
 				Computed:            true,
@@ -168,6 +304,206 @@ func (r *BuildResource) Schema(ctx context.Context, req resource.SchemaRequest,
 	}
 }
 
+// buildOptions extracts the resource-level build settings.
+func (data *BuildResourceModel) buildOptions(ctx context.Context) (buildOptions, error) {
+	sde, err := resolveSourceDateEpoch(data.SourceDateEpoch, data.popts)
+	if err != nil {
+		return buildOptions{}, err
+	}
+	base, err := resolveBaseLayers(ctx, data.BaseLayersFrom, data.popts)
+	if err != nil {
+		return buildOptions{}, err
+	}
+	return buildOptions{
+		verifyReproducible:  data.VerifyReproducible.ValueBool(),
+		sourceDateEpoch:     sde,
+		baseLayers:          base,
+		maxCompressedSize:   data.MaxCompressedSize.ValueInt64Pointer(),
+		maxUncompressedSize: data.MaxUncompressedSize.ValueInt64Pointer(),
+	}, nil
+}
+
+func (r *BuildResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var data BuildResourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The per-arch configs typically come from apko_config, so they are often
+	// unknown until apply.
+	if data.Configs.IsNull() || !isFullyKnown(ctx, data.Configs) || len(data.Configs.Elements()) == 0 {
+		return
+	}
+
+	byArch, err := decodeConfigs(ctx, data.Configs.Elements())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("configs"), "Invalid configs", err.Error())
+		return
+	}
+	extra, err := checkArchConfigs(byArch)
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("configs"), "Invalid configs", err.Error())
+		return
+	}
+	if len(extra) != 0 {
+		resp.Diagnostics.AddAttributeWarning(path.Root("configs"), "Unused configs",
+			fmt.Sprintf("The index configuration does not list archs %v, so their configs will be ignored.", extra))
+	}
+}
+
+// ModifyPlan predicts the digest of the image when its configuration changes,
+// so that changes which don't affect the image (e.g. to "config" when
+// "configs" is set) don't force a replacement and leave everything that
+// depends on "image_ref" unknown until apply.
+func (r *BuildResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Nothing to predict when creating or destroying the resource.
+	if req.Plan.Raw.IsNull() || req.State.Raw.IsNull() {
+		return
+	}
+
+	var plan, state *BuildResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	plan.popts = r.popts
+
+	var changed []path.Path
+	if !plan.Config.Equal(state.Config) {
+		changed = append(changed, path.Root("config"))
+	}
+	if !plan.Configs.Equal(state.Configs) {
+		changed = append(changed, path.Root("configs"))
+	}
+	if !plan.SourceDateEpoch.Equal(state.SourceDateEpoch) {
+		changed = append(changed, path.Root("source_date_epoch"))
+	}
+	if !plan.BaseLayersFrom.Equal(state.BaseLayersFrom) {
+		changed = append(changed, path.Root("base_layers_from"))
+	}
+	if len(changed) == 0 {
+		if !plan.Repo.Equal(state.Repo) {
+			// Changing the repo replaces the resource.
+			return
+		}
+		// Other changes, e.g. to tags, don't rebuild the image.
+		resp.Diagnostics.Append(plan.keepImage(ctx, state)...)
+		resp.Diagnostics.Append(resp.Plan.Set(ctx, &plan)...)
+		return
+	}
+
+	digest, err := r.predictDigest(ctx, *plan)
+	if err != nil {
+		if !unavailableAtPlan(err) {
+			// The build would fail at apply too, after the image has
+			// been destroyed.
+			resp.Diagnostics.AddError("Unable to build image", err.Error())
+			return
+		}
+		resp.Diagnostics.AddWarning("Unable to predict image digest",
+			fmt.Sprintf("The image couldn't be built while planning, so it is planned to be rebuilt and replaced: %v", err))
+		resp.RequiresReplace = append(resp.RequiresReplace, changed...)
+		return
+	}
+	if digest == "" || digest != state.ImageRef.ValueString() {
+		resp.RequiresReplace = append(resp.RequiresReplace, changed...)
+		return
+	}
+
+	tflog.Debug(ctx, fmt.Sprintf("predicted digest %s matches state, planning in-place update", digest))
+	resp.Diagnostics.Append(plan.keepImage(ctx, state)...)
+	resp.Diagnostics.Append(resp.Plan.Set(ctx, &plan)...)
+}
+
+// keepImage plans to keep the image that was already published, along with
+// the outputs derived from it.
+func (data *BuildResourceModel) keepImage(ctx context.Context, state *BuildResourceModel) diag.Diagnostics {
+	data.Id = state.Id
+	data.ImageRef = state.ImageRef
+	data.Pushed = state.Pushed
+	data.BuildDate = state.BuildDate
+	data.SBOMs = state.SBOMs
+	data.ImageSizes = state.ImageSizes
+	if data.ImageTarballsDir.Equal(state.ImageTarballsDir) {
+		data.ImageTarballs = state.ImageTarballs
+	}
+	diags := checkImageSizes(data.ImageSizes, data.MaxCompressedSize, data.MaxUncompressedSize)
+	return append(diags, data.planMirrorRefs(ctx)...)
+}
+
+// planMirrorRefs sets mirror_refs from the image_ref, when the mirror_repos
+// are known.
+func (data *BuildResourceModel) planMirrorRefs(ctx context.Context) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !isFullyKnown(ctx, data.MirrorRepos) {
+		return diags
+	}
+	repos, err := stringList(ctx, data.MirrorRepos)
+	if err != nil {
+		diags.AddError("Client Error", err.Error())
+		return diags
+	}
+	refs, err := mirrorRefs(data.ImageRef.ValueString(), repos)
+	if err != nil {
+		diags.AddError("Client Error", err.Error())
+		return diags
+	}
+	data.MirrorRefs = refs
+	return diags
+}
+
+// predictDigest performs the build described by the plan without publishing
+// it and returns the resulting fully-qualified digest. It returns an empty
+// string when the build can't be performed at plan time.
+func (r *BuildResource) predictDigest(ctx context.Context, data BuildResourceModel) (string, error) {
+	if r.popts.planOffline {
+		return "", nil
+	}
+	if !isFullyKnown(ctx, data.Repo) || !isFullyKnown(ctx, data.Config) || !isFullyKnown(ctx, data.Configs) || data.SourceDateEpoch.IsUnknown() || !isFullyKnown(ctx, data.BaseLayersFrom) {
+		return "", nil
+	}
+
+	repo, err := name.NewRepository(data.Repo.ValueString())
+	if err != nil {
+		return "", fmt.Errorf("parsing repo: %w", err)
+	}
+
+	// Verifying reproducibility is left to apply, it doesn't change the digest.
+	data.VerifyReproducible = types.BoolNull()
+
+	tempDir, err := os.MkdirTemp("", "apko-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	digest, _, sboms, err := doBuild(ctx, data, tempDir)
+	if err != nil {
+		return "", err
+	}
+	// The SBOMs are written outside of tempDir, and nothing will read them.
+	for _, sb := range sboms {
+		os.Remove(sb.predicatePath)
+	}
+
+	return repo.Digest(digest.String()).String(), nil
+}
+
+// unavailableAtPlan reports whether err means that the build couldn't run
+// while planning, e.g. because a repository or registry couldn't be reached,
+// rather than that it would fail at apply too.
+func unavailableAtPlan(err error) bool {
+	if _, ok := errors.AsType[net.Error](err); ok {
+		return true
+	}
+	if terr, ok := errors.AsType[*transport.Error](err); ok {
+		return terr.Temporary()
+	}
+	return false
+}
+
 func (r *BuildResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
 	var data *BuildResourceModel
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
@@ -196,11 +532,17 @@ func (r *BuildResource) Create(ctx context.Context, req resource.CreateRequest,
 	}
 	dig := repo.Digest(digest.String())
 
-	if p := data.OciLayoutPath.ValueString(); p != "" {
-		if err := writeImageLayout(p, se); err != nil {
-			resp.Diagnostics.AddError("Client Error", err.Error())
-			return
-		}
+	if err := data.writeImageLayout(ctx, repo, se); err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	if err := data.writeImageTarballs(ctx, repo, se); err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	if err := data.writeRootFS(se); err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
 	}
 
 	pushable, ok := se.(remote.Taggable)
@@ -209,21 +551,47 @@ func (r *BuildResource) Create(ctx context.Context, req resource.CreateRequest,
 		return
 	}
 
-	pusher, err := remote.NewPusher(r.popts.ropts...)
+	pushed, err := r.popts.publish(ctx, dig, pushable)
 	if err != nil {
-		resp.Diagnostics.AddError("NewPusher", err.Error())
+		resp.Diagnostics.AddError(pushDiagnostic(dig, err))
 		return
 	}
-	if err := retry(ctx, longBackoff, func(ctx context.Context) error {
-		return pusher.Push(ctx, dig, pushable)
-	}); err != nil {
-		resp.Diagnostics.AddError("Error publishing "+dig.String(), err.Error())
+	data.Pushed = types.BoolValue(pushed)
+
+	tags, err := tagList(ctx, data.Tags)
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	if err := r.popts.pushTags(ctx, repo, tags, pushable); err != nil {
+		resp.Diagnostics.AddError("Error tagging "+dig.String(), err.Error())
+		return
+	}
+
+	mirrors, err := stringList(ctx, data.MirrorRepos)
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	if err := r.popts.replicate(ctx, dig, mirrors); err != nil {
+		resp.Diagnostics.AddError("Error publishing "+dig.String()+" to mirror_repos", err.Error())
+		return
+	}
+	if data.MirrorRefs, err = mirrorRefs(dig.String(), mirrors); err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
 		return
 	}
 
 	data.Id = types.StringValue(dig.String())
 	data.ImageRef = types.StringValue(dig.String())
 
+	buildDate, err := indexBuildDate(se)
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	data.BuildDate = types.StringValue(buildDate)
+
 	sbv := make(map[string]attr.Value, len(sboms))
 	for k, v := range sboms {
 		val, diags := types.ObjectValue(digestSBOMSchema.AttrTypes, map[string]attr.Value{
@@ -245,6 +613,12 @@ func (r *BuildResource) Create(ctx context.Context, req resource.CreateRequest,
 	}
 	data.SBOMs = sv
 
+	data.ImageSizes, diags = imageSizes(sboms)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
 	tflog.Trace(ctx, "created a resource")
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
@@ -259,39 +633,97 @@ func (r *BuildResource) Read(ctx context.Context, req resource.ReadRequest, resp
 
 	// We "lock" the config and changes to it already require replacement.
 
+	// Forget the layout if the image is no longer in it, so that the plan
+	// writes it again.
+	if ok, err := data.hasImageLayout(ctx); err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("unable to check oci_layout_path: %v", err))
+	} else if !ok {
+		data.OciLayoutPath = types.StringNull()
+	}
+
+	// Drop the tags that no longer point at the image, so that the plan
+	// points them back.
+	tags, err := tagList(ctx, data.Tags)
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	if len(tags) != 0 && !r.popts.planOffline {
+		dig, err := name.NewDigest(data.ImageRef.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error parsing image_ref: %v", err))
+			return
+		}
+		current, err := r.popts.taggedAt(ctx, dig, tags)
+		if err != nil {
+			tflog.Warn(ctx, fmt.Sprintf("unable to check tags: %v", err))
+		} else if len(current) != len(tags) {
+			v, diags := types.SetValueFrom(ctx, basetypes.StringType{}, current)
+			resp.Diagnostics.Append(diags...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+			data.Tags = v
+		}
+	}
+
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
 func (r *BuildResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
-	var data *BuildResourceModel
+	var data, state *BuildResourceModel
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
 	data.popts = r.popts
 
-	repo, err := name.NewRepository(data.Repo.ValueString())
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error parsing repo: %v", err))
+	// ModifyPlan only plans an update when it verified that the new
+	// configuration produces the image we already published, and plans a
+	// replacement otherwise, so there is nothing to build here.
+	if data.ImageRef.IsUnknown() {
+		resp.Diagnostics.AddError("Client Error", "image_ref is unknown, the image should have been planned to be replaced")
 		return
 	}
-
-	tempDir, err := os.MkdirTemp("", "apko-*")
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Errorf("failed to create temporary directory: %w", err).Error())
+	if err := r.updateTags(ctx, data, state); err != nil {
+		resp.Diagnostics.AddError("Error tagging "+data.ImageRef.ValueString(), err.Error())
 		return
 	}
-	defer os.RemoveAll(tempDir)
-
-	digest, _, _, err := doBuild(ctx, *data, tempDir)
-	if err != nil {
+	if err := r.updateMirrors(ctx, data, state); err != nil {
+		resp.Diagnostics.AddError("Error publishing "+data.ImageRef.ValueString()+" to mirror_repos", err.Error())
+		return
+	}
+	if err := data.ensureImageLayout(ctx, state); err != nil {
 		resp.Diagnostics.AddError("Client Error", err.Error())
 		return
 	}
-	dig := repo.Digest(digest.String()).String()
-
-	data.Id = types.StringValue(dig)
-	data.ImageRef = types.StringValue(dig)
+	rootfsChanged := !data.RootFSPath.Equal(state.RootFSPath) || !data.RootFSArch.Equal(state.RootFSArch)
+	if data.ImageTarballs.IsUnknown() || rootfsChanged {
+		// The files are written from the published image.
+		dig, err := name.NewDigest(data.ImageRef.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error parsing image_ref: %v", err))
+			return
+		}
+		idx, err := remote.Index(dig, append(r.popts.ropts, remote.WithContext(ctx))...)
+		if err != nil {
+			resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error fetching %s: %v", dig, err))
+			return
+		}
+		if data.ImageTarballs.IsUnknown() {
+			if err := data.writeImageTarballs(ctx, dig.Repository, idx); err != nil {
+				resp.Diagnostics.AddError("Client Error", err.Error())
+				return
+			}
+		}
+		if rootfsChanged {
+			if err := data.writeRootFS(idx); err != nil {
+				resp.Diagnostics.AddError("Client Error", err.Error())
+				return
+			}
+		}
+	}
 
 	tflog.Trace(ctx, "updated a resource")
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
@@ -305,8 +737,99 @@ func (r *BuildResource) Delete(ctx context.Context, req resource.DeleteRequest,
 	}
 
 	// TODO: If we ever want to delete the image from the registry, we can do it here.
+
+	if !data.DeleteTagsOnDestroy.ValueBool() {
+		return
+	}
+	tags, err := tagList(ctx, data.Tags)
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	if len(tags) == 0 {
+		return
+	}
+	dig, err := name.NewDigest(data.ImageRef.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error parsing image_ref: %v", err))
+		return
+	}
+	if err := r.popts.untag(ctx, dig, tags); err != nil {
+		resp.Diagnostics.AddError("Error deleting tags", err.Error())
+	}
+}
+
+// updateTags points the planned tags at the image, those that were already
+// there included if the image changed, and deletes the tags that were removed
+// if delete_tags_on_destroy is set.
+func (r *BuildResource) updateTags(ctx context.Context, plan, state *BuildResourceModel) error {
+	tags, err := tagList(ctx, plan.Tags)
+	if err != nil {
+		return err
+	}
+	old, err := tagList(ctx, state.Tags)
+	if err != nil {
+		return err
+	}
+	dig, err := name.NewDigest(plan.ImageRef.ValueString())
+	if err != nil {
+		return fmt.Errorf("parsing image_ref: %w", err)
+	}
+
+	var added, removed []string
+	for _, tag := range tags {
+		if !slices.Contains(old, tag) || !plan.ImageRef.Equal(state.ImageRef) {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range old {
+		if !slices.Contains(tags, tag) {
+			removed = append(removed, tag)
+		}
+	}
+
+	if err := r.popts.retag(ctx, dig, added); err != nil {
+		return err
+	}
+	if !plan.DeleteTagsOnDestroy.ValueBool() || len(removed) == 0 {
+		return nil
+	}
+	sdig, err := name.NewDigest(state.ImageRef.ValueString())
+	if err != nil {
+		return fmt.Errorf("parsing image_ref: %w", err)
+	}
+	return r.popts.untag(ctx, sdig, removed)
 }
 
 func (r *BuildResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
 	resource.ImportStatePassthroughID(ctx, path.Root("id"), req, resp)
 }
+
+// updateMirrors publishes the image to the planned mirror_repos it isn't in
+// yet, and sets mirror_refs.
+func (r *BuildResource) updateMirrors(ctx context.Context, plan, state *BuildResourceModel) error {
+	mirrors, err := stringList(ctx, plan.MirrorRepos)
+	if err != nil {
+		return err
+	}
+	old, err := stringList(ctx, state.MirrorRepos)
+	if err != nil {
+		return err
+	}
+	dig, err := name.NewDigest(plan.ImageRef.ValueString())
+	if err != nil {
+		return fmt.Errorf("parsing image_ref: %w", err)
+	}
+
+	var added []string
+	for _, m := range mirrors {
+		if !slices.Contains(old, m) || !plan.ImageRef.Equal(state.ImageRef) {
+			added = append(added, m)
+		}
+	}
+	if err := r.popts.replicate(ctx, dig, added); err != nil {
+		return err
+	}
+	plan.MirrorRefs, err = mirrorRefs(dig.String(), mirrors)
+	return err
+}
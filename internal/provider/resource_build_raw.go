@@ -8,6 +8,7 @@ import (
 	"github.com/chainguard-dev/terraform-provider-oci/pkg/validators"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
 	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
@@ -22,8 +23,10 @@ import (
 )
 
 var (
-	_ resource.Resource                = &BuildRawResource{}
-	_ resource.ResourceWithImportState = &BuildRawResource{}
+	_ resource.Resource                   = &BuildRawResource{}
+	_ resource.ResourceWithImportState    = &BuildRawResource{}
+	_ resource.ResourceWithValidateConfig = &BuildRawResource{}
+	_ resource.ResourceWithModifyPlan     = &BuildRawResource{}
 )
 
 func NewBuildRawResource() resource.Resource {
@@ -39,6 +42,14 @@ type BuildRawResourceModel struct {
 	Repo       types.String `tfsdk:"repo"`
 	ConfigsRaw types.Map    `tfsdk:"configs_raw"`
 	ImageRef   types.String `tfsdk:"image_ref"`
+	Pushed     types.Bool   `tfsdk:"pushed"`
+
+	SourceDateEpoch types.String `tfsdk:"source_date_epoch"`
+	BuildDate       types.String `tfsdk:"build_date"`
+
+	MaxCompressedSize   types.Int64 `tfsdk:"max_compressed_size"`
+	MaxUncompressedSize types.Int64 `tfsdk:"max_uncompressed_size"`
+	ImageSizes          types.Map   `tfsdk:"image_sizes"`
 
 	SBOMs types.Map `tfsdk:"sboms"`
 
@@ -96,6 +107,37 @@ func (r *BuildRawResource) Schema(ctx context.Context, req resource.SchemaReques
 				MarkdownDescription: "The resulting fully-qualified digest (e.g. {repo}@sha256:deadbeef).",
 				Computed:            true,
 			},
+			"pushed": schema.BoolAttribute{
+				MarkdownDescription: "Whether the image was pushed when it was published, rather than found to be already present in the registry.",
+				Computed:            true,
+			},
+			"source_date_epoch": schema.StringAttribute{
+				MarkdownDescription: "The build date for the image and its index, as an RFC3339 timestamp or a number of seconds since the unix epoch. Overrides the provider's `source_date_epoch`, the `SOURCE_DATE_EPOCH` environment variable, and the build date derived from the installed packages. Per-architecture SBOMs still record the newest package build date when it is later.",
+				Optional:            true,
+				Validators:          []validator.String{sourceDateEpochValidator{}},
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"build_date": schema.StringAttribute{
+				MarkdownDescription: "The RFC3339 build date recorded on the resulting index.",
+				Computed:            true,
+			},
+			"max_compressed_size": schema.Int64Attribute{
+				MarkdownDescription: maxCompressedSizeDescription,
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"max_uncompressed_size": schema.Int64Attribute{
+				MarkdownDescription: maxUncompressedSizeDescription,
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"image_sizes": imageSizesAttribute,
 			"sboms": schema.MapNestedAttribute{
 				MarkdownDescription: "A map from the APK architecture to the digest for that architecture and its SBOM.",
 				Computed:            true,
@@ -148,6 +190,58 @@ func (data *BuildRawResourceModel) rawConfigs() (map[string]string, error) {
 	return out, nil
 }
 
+// buildOptions extracts the resource-level build settings.
+func (data *BuildRawResourceModel) buildOptions() (buildOptions, error) {
+	sde, err := resolveSourceDateEpoch(data.SourceDateEpoch, data.popts)
+	if err != nil {
+		return buildOptions{}, err
+	}
+	return buildOptions{
+		sourceDateEpoch:     sde,
+		maxCompressedSize:   data.MaxCompressedSize.ValueInt64Pointer(),
+		maxUncompressedSize: data.MaxUncompressedSize.ValueInt64Pointer(),
+	}, nil
+}
+
+func (r *BuildRawResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var data BuildRawResourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if data.ConfigsRaw.IsNull() || data.ConfigsRaw.IsUnknown() {
+		return
+	}
+
+	// Decode whichever entries are known now, but only cross-check the
+	// architectures once all of them are.
+	known := make(map[string]string, len(data.ConfigsRaw.Elements()))
+	for arch, v := range data.ConfigsRaw.Elements() {
+		if sv, ok := v.(basetypes.StringValue); ok && !sv.IsUnknown() && !sv.IsNull() {
+			known[arch] = sv.ValueString()
+		}
+	}
+
+	byArch, err := decodeRawConfigs(ctx, known)
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("configs_raw"), "Invalid configs_raw", err.Error())
+		return
+	}
+	if len(known) != len(data.ConfigsRaw.Elements()) {
+		return
+	}
+
+	extra, err := checkArchConfigs(byArch)
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("configs_raw"), "Invalid configs_raw", err.Error())
+		return
+	}
+	if len(extra) != 0 {
+		resp.Diagnostics.AddAttributeWarning(path.Root("configs_raw"), "Unused configs_raw",
+			fmt.Sprintf("The index configuration does not list archs %v, so their configs will be ignored.", extra))
+	}
+}
+
 func (r *BuildRawResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
 	var data *BuildRawResourceModel
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
@@ -175,7 +269,13 @@ func (r *BuildRawResource) Create(ctx context.Context, req resource.CreateReques
 		return
 	}
 
-	digest, se, sboms, err := doBuildRaw(ctx, configs, data.popts, tempDir)
+	bopts, err := data.buildOptions()
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+
+	digest, se, sboms, err := doBuildRaw(ctx, configs, data.popts, bopts, tempDir)
 	if err != nil {
 		resp.Diagnostics.AddError("Client Error", err.Error())
 		return
@@ -188,21 +288,23 @@ func (r *BuildRawResource) Create(ctx context.Context, req resource.CreateReques
 		return
 	}
 
-	pusher, err := remote.NewPusher(r.popts.ropts...)
+	pushed, err := r.popts.publish(ctx, dig, pushable)
 	if err != nil {
-		resp.Diagnostics.AddError("NewPusher", err.Error())
-		return
-	}
-	if err := retry(ctx, longBackoff, func(ctx context.Context) error {
-		return pusher.Push(ctx, dig, pushable)
-	}); err != nil {
-		resp.Diagnostics.AddError("Error publishing "+dig.String(), err.Error())
+		resp.Diagnostics.AddError(pushDiagnostic(dig, err))
 		return
 	}
+	data.Pushed = types.BoolValue(pushed)
 
 	data.Id = types.StringValue(dig.String())
 	data.ImageRef = types.StringValue(dig.String())
 
+	buildDate, err := indexBuildDate(se)
+	if err != nil {
+		resp.Diagnostics.AddError("Client Error", err.Error())
+		return
+	}
+	data.BuildDate = types.StringValue(buildDate)
+
 	sbv := make(map[string]attr.Value, len(sboms))
 	for k, v := range sboms {
 		val, diags := types.ObjectValue(digestSBOMSchema.AttrTypes, map[string]attr.Value{
@@ -224,10 +326,45 @@ func (r *BuildRawResource) Create(ctx context.Context, req resource.CreateReques
 	}
 	data.SBOMs = sv
 
+	data.ImageSizes, diags = imageSizes(sboms)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
 	tflog.Trace(ctx, "created a resource")
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
+func (r *BuildRawResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Nothing to keep when creating or destroying the resource.
+	if req.Plan.Raw.IsNull() || req.State.Raw.IsNull() {
+		return
+	}
+
+	var plan, state *BuildRawResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Changes to these replace the resource.
+	if !plan.Repo.Equal(state.Repo) || !plan.ConfigsRaw.Equal(state.ConfigsRaw) || !plan.SourceDateEpoch.Equal(state.SourceDateEpoch) {
+		return
+	}
+
+	// Other changes, e.g. to the size budgets, don't rebuild the image.
+	plan.Id = state.Id
+	plan.ImageRef = state.ImageRef
+	plan.Pushed = state.Pushed
+	plan.BuildDate = state.BuildDate
+	plan.SBOMs = state.SBOMs
+	plan.ImageSizes = state.ImageSizes
+	resp.Diagnostics.Append(checkImageSizes(plan.ImageSizes, plan.MaxCompressedSize, plan.MaxUncompressedSize)...)
+	resp.Diagnostics.Append(resp.Plan.Set(ctx, &plan)...)
+}
+
 func (r *BuildRawResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
 	var data *BuildRawResourceModel
 	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
@@ -247,34 +384,13 @@ func (r *BuildRawResource) Update(ctx context.Context, req resource.UpdateReques
 	}
 	data.popts = r.popts
 
-	repo, err := name.NewRepository(data.Repo.ValueString())
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error parsing repo: %v", err))
-		return
-	}
-
-	tempDir, err := os.MkdirTemp("", "apko-*")
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Errorf("failed to create temporary directory: %w", err).Error())
+	// ModifyPlan keeps the image_ref when nothing that shapes the image
+	// changed, and the resource is replaced otherwise, so there is nothing
+	// to build here.
+	if data.ImageRef.IsUnknown() {
+		resp.Diagnostics.AddError("Client Error", "image_ref is unknown, the image should have been planned to be replaced")
 		return
 	}
-	defer os.RemoveAll(tempDir)
-
-	configs, err := data.rawConfigs()
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", err.Error())
-		return
-	}
-
-	digest, _, _, err := doBuildRaw(ctx, configs, data.popts, tempDir)
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", err.Error())
-		return
-	}
-	dig := repo.Digest(digest.String()).String()
-
-	data.Id = types.StringValue(dig)
-	data.ImageRef = types.StringValue(dig)
 
 	tflog.Trace(ctx, "updated a resource")
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
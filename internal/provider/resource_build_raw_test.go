@@ -9,6 +9,7 @@ import (
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/plancheck"
 )
 
 // TestAccResourceApkoBuildRaw tests a basic raw build where optional fields
@@ -314,3 +315,157 @@ resource "apko_build_raw" "foo" {
 		},
 	})
 }
+
+// TestAccResourceApkoBuildRaw_ArchMismatch verifies that an index listing
+// archs without a matching per-arch config is rejected before apply.
+func TestAccResourceApkoBuildRaw_ArchMismatch(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+locals {
+  config = jsonencode({
+    contents = {
+      repositories = ["https://packages.wolfi.dev/os"]
+      keyring      = ["https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"]
+      packages     = ["wolfi-baselayout"]
+    }
+    archs = ["x86_64", "aarch64"]
+  })
+}
+
+resource "apko_build_raw" "foo" {
+  repo = %q
+  configs_raw = {
+    "index" = local.config
+    "amd64" = local.config
+  }
+}
+`, repostr),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`there is no configuration for \[arm64\]`),
+			},
+		},
+	})
+}
+
+// TestAccResourceApkoBuildRaw_SourceDateEpoch verifies that source_date_epoch
+// is reflected in the computed build_date.
+func TestAccResourceApkoBuildRaw_SourceDateEpoch(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+locals {
+  config = jsonencode({
+    contents = {
+      repositories = ["https://packages.wolfi.dev/os"]
+      keyring      = ["https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"]
+      packages     = ["wolfi-baselayout"]
+    }
+    archs = ["x86_64"]
+  })
+}
+
+resource "apko_build_raw" "foo" {
+  repo = %q
+  configs_raw = {
+    "index" = local.config
+    "amd64" = local.config
+  }
+  source_date_epoch = "2024-01-01T00:00:00Z"
+}
+`, repostr),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("apko_build_raw.foo", "build_date", "2024-01-01T00:00:00Z"),
+				),
+			},
+		},
+	})
+}
+
+// TestAccResourceApkoBuildRaw_SizeBudgets verifies that the size budgets fail
+// builds of images that are too large, and that changing them checks the
+// image that was already built without rebuilding it.
+func TestAccResourceApkoBuildRaw_SizeBudgets(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+	config := func(budget string) string {
+		return fmt.Sprintf(`
+locals {
+  config = jsonencode({
+    contents = {
+      repositories = ["https://packages.wolfi.dev/os"]
+      keyring      = ["https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"]
+      packages     = ["wolfi-baselayout", "ca-certificates-bundle"]
+    }
+    archs = ["x86_64"]
+  })
+}
+
+resource "apko_build_raw" "foo" {
+  repo = %q
+  configs_raw = {
+    "index" = local.config
+  }
+  %s
+}
+`, repostr, budget)
+	}
+
+	var imageRef string
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{{
+			Config:      config("max_compressed_size = 1"),
+			ExpectError: regexp.MustCompile(`over the max_compressed_size`),
+		}, {
+			Config: config("max_uncompressed_size = 100000000"),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("apko_build_raw.foo", "image_sizes.%", "1"),
+				resource.TestCheckResourceAttrWith("apko_build_raw.foo", "image_ref", func(v string) error {
+					imageRef = v
+					return nil
+				}),
+			),
+		}, {
+			// Raising the budget keeps the image.
+			Config: config("max_uncompressed_size = 200000000"),
+			ConfigPlanChecks: resource.ConfigPlanChecks{
+				PreApply: []plancheck.PlanCheck{
+					plancheck.ExpectResourceAction("apko_build_raw.foo", plancheck.ResourceActionUpdate),
+				},
+			},
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttrWith("apko_build_raw.foo", "image_ref", func(v string) error {
+					if v != imageRef {
+						return fmt.Errorf("image_ref changed from %s to %s", imageRef, v)
+					}
+					return nil
+				}),
+				resource.TestCheckResourceAttr("apko_build_raw.foo", "pushed", "true"),
+			),
+		}, {
+			// Lowering it below the size of the image fails the plan.
+			Config:      config("max_uncompressed_size = 1"),
+			ExpectError: regexp.MustCompile(`Image over size budget`),
+		}},
+	})
+}
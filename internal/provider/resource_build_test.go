@@ -6,17 +6,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"chainguard.dev/apko/pkg/sbom/generator/spdx"
 	ocitesting "github.com/chainguard-dev/terraform-provider-oci/testing"
 	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/plancheck"
 	"github.com/hashicorp/terraform-plugin-testing/terraform"
 )
 
@@ -428,6 +439,107 @@ resource "apko_build" "foo" {
 	})
 }
 
+// TestAccResourceApkoBuild_PredictedDigest verifies that a config change that
+// doesn't affect the image is planned as an in-place update that keeps the
+// image_ref, rather than a replacement.
+func TestAccResourceApkoBuild_PredictedDigest(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+
+	cfg := func(extra string) string {
+		return fmt.Sprintf(`
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  packages:
+    - ca-certificates-bundle
+    - tzdata
+  EOF
+}
+
+data "apko_config" "bar" {
+  config_contents = <<EOF
+contents:
+  packages:
+    - ca-certificates-bundle
+    - tzdata
+    - %s
+  EOF
+}
+
+resource "apko_build" "foo" {
+	repo    = %q
+	# With configs set, config doesn't factor into the build.
+	config  = data.apko_config.bar.config
+	configs = data.apko_config.foo.configs
+}
+`, extra, repostr)
+	}
+
+	var imageRef string
+	resource.Test(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories:       []string{"https://packages.wolfi.dev/os"},
+				buildRespositories: []string{"./packages"},
+				keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:              []string{"x86_64", "aarch64"},
+				packages:           []string{"wolfi-baselayout"},
+			}),
+		}, Steps: []resource.TestStep{
+			{
+				Config: cfg("busybox"),
+				Check: resource.TestCheckResourceAttrWith("apko_build.foo", "image_ref", func(value string) error {
+					imageRef = value
+					return nil
+				}),
+			},
+			{
+				Config: cfg("bash"),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectResourceAction("apko_build.foo", plancheck.ResourceActionUpdate),
+					},
+				},
+				Check: resource.TestCheckResourceAttrWith("apko_build.foo", "image_ref", func(value string) error {
+					if value != imageRef {
+						return fmt.Errorf("image_ref changed from %s to %s", imageRef, value)
+					}
+					return nil
+				}),
+			},
+			{
+				// A build that would fail at apply fails the plan, rather
+				// than planning to replace the image.
+				Config:      strings.Replace(cfg("bash"), "configs = data.apko_config.foo.configs", "configs = data.apko_config.bar.configs\n\tmax_compressed_size = 1", 1),
+				ExpectError: regexp.MustCompile(`Unable to build image`),
+			},
+		},
+	})
+}
+
+func TestUnavailableAtPlan(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unreachable", fmt.Errorf("fetching index: %w", &url.Error{Op: "Get", URL: "https://packages.example.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}), true},
+		{"registry unavailable", fmt.Errorf("reading base image: %w", &transport.Error{StatusCode: http.StatusServiceUnavailable}), true},
+		{"registry denied", fmt.Errorf("reading base image: %w", &transport.Error{StatusCode: http.StatusForbidden}), false},
+		{"over budget", errors.New("the x86_64 image is over budget"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := unavailableAtPlan(tc.err); got != tc.want {
+				t.Errorf("unavailableAtPlan(%v) = %t, wanted %t", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
 // Use layers!
 func TestAccResourceApkoBuild_Layers(t *testing.T) {
 	repo, cleanup := ocitesting.SetupRepository(t, "test")
@@ -496,8 +608,9 @@ resource "apko_build" "foo" {
 }
 
 // TestAccResourceApkoBuild_OciLayoutPath verifies that when oci_layout_path is
-// set, the resource writes a valid OCI image layout to that directory and the
-// image inside has the same digest as the pushed image_ref.
+// set, the resource writes a valid OCI image layout to that directory, the
+// image inside has the same digest as the pushed image_ref, and the layout is
+// written again if it is deleted.
 func TestAccResourceApkoBuild_OciLayoutPath(t *testing.T) {
 	repo, cleanup := ocitesting.SetupRepository(t, "test")
 	defer cleanup()
@@ -507,6 +620,62 @@ func TestAccResourceApkoBuild_OciLayoutPath(t *testing.T) {
 	// create it via MkdirAll.
 	layoutDir := t.TempDir() + "/layout"
 
+	config := func(tags string) string {
+		return fmt.Sprintf(`
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+  - glibc-locale-posix=2.42-r2
+  - tzdata=2025b-r2
+EOF
+}
+
+resource "apko_build" "foo" {
+  repo            = %q
+  config          = data.apko_config.foo.config
+  oci_layout_path = %q
+  %s
+}
+`, repostr, layoutDir, tags)
+	}
+
+	// The index is the only image in the layout, as the given tag of the
+	// repo.
+	checkLayout := func(tag string) resource.TestCheckFunc {
+		return func(s *terraform.State) error {
+			rs, ok := s.RootModule().Resources["apko_build.foo"]
+			if !ok {
+				return errors.New("apko_build.foo not in state")
+			}
+			p, err := layout.FromPath(layoutDir)
+			if err != nil {
+				return fmt.Errorf("layout.FromPath(%q): %w", layoutDir, err)
+			}
+			idx, err := p.ImageIndex()
+			if err != nil {
+				return fmt.Errorf("reading layout index: %w", err)
+			}
+			im, err := idx.IndexManifest()
+			if err != nil {
+				return fmt.Errorf("reading layout index: %w", err)
+			}
+			if len(im.Manifests) != 1 {
+				return fmt.Errorf("layout has %d manifests, wanted 1", len(im.Manifests))
+			}
+			desc := im.Manifests[0]
+			if got, want := desc.Annotations["org.opencontainers.image.ref.name"], repo.Tag(tag).String(); got != want {
+				return fmt.Errorf("layout ref name %q != %q", got, want)
+			}
+			want := rs.Primary.Attributes["image_ref"]
+			if got := repo.Digest(desc.Digest.String()).String(); got != want {
+				return fmt.Errorf("layout digest %s != image_ref %s", got, want)
+			}
+			return nil
+		}
+	}
+
 	resource.UnitTest(t, resource.TestCase{
 		PreCheck: func() { testAccPreCheck(t) },
 		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
@@ -519,7 +688,43 @@ func TestAccResourceApkoBuild_OciLayoutPath(t *testing.T) {
 			}),
 		},
 		Steps: []resource.TestStep{{
-			Config: fmt.Sprintf(`
+			Config: config(""),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("apko_build.foo", "oci_layout_path", layoutDir),
+				checkLayout("latest"),
+			),
+		}, {
+			// The refresh notices that the layout has been deleted, and
+			// the update writes it again.
+			PreConfig: func() {
+				if err := os.RemoveAll(layoutDir); err != nil {
+					t.Fatal(err)
+				}
+			},
+			Config: config(""),
+			ConfigPlanChecks: resource.ConfigPlanChecks{
+				PreApply: []plancheck.PlanCheck{
+					plancheck.ExpectResourceAction("apko_build.foo", plancheck.ResourceActionUpdate),
+				},
+			},
+			Check: checkLayout("latest"),
+		}, {
+			// Tagging the image renames it in the layout.
+			Config: config(`tags = ["v1"]`),
+			Check:  checkLayout("v1"),
+		}},
+	})
+}
+
+// TestAccResourceApkoBuild_Tags verifies that tags are pushed with the image,
+// pointed back at it when they are moved, and deleted when they are removed.
+func TestAccResourceApkoBuild_Tags(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+	repostr := repo.String()
+
+	config := func(tags string) string {
+		return fmt.Sprintf(`
 data "apko_config" "foo" {
   config_contents = <<EOF
 contents:
@@ -531,33 +736,334 @@ EOF
 }
 
 resource "apko_build" "foo" {
-  repo            = %q
-  config          = data.apko_config.foo.config
-  oci_layout_path = %q
+  repo                   = %q
+  config                 = data.apko_config.foo.config
+  tags                   = %s
+  delete_tags_on_destroy = true
 }
-`, repostr, layoutDir),
+`, repostr, tags)
+	}
+
+	// taggedAt checks that each of tags points at the image.
+	taggedAt := func(tags ...string) resource.TestCheckFunc {
+		return func(s *terraform.State) error {
+			rs, ok := s.RootModule().Resources["apko_build.foo"]
+			if !ok {
+				return errors.New("apko_build.foo not in state")
+			}
+			want := rs.Primary.Attributes["image_ref"]
+			for _, tag := range tags {
+				d, err := crane.Digest(repo.Tag(tag).String())
+				if err != nil {
+					return fmt.Errorf("crane.Digest(%s): %w", tag, err)
+				}
+				if got := repo.Digest(d).String(); got != want {
+					return fmt.Errorf("%s points at %s, wanted %s", tag, got, want)
+				}
+			}
+			return nil
+		}
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories:       []string{"https://packages.wolfi.dev/os"},
+				buildRespositories: []string{"./packages"},
+				keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:              []string{"x86_64"},
+				packages:           []string{"wolfi-baselayout=20230201-r24"},
+			}),
+		},
+		Steps: []resource.TestStep{{
+			Config: config(`["latest", "v1"]`),
 			Check: resource.ComposeTestCheckFunc(
-				resource.TestCheckResourceAttr("apko_build.foo", "oci_layout_path", layoutDir),
+				resource.TestCheckResourceAttr("apko_build.foo", "tags.#", "2"),
+				resource.TestCheckResourceAttr("apko_build.foo", "pushed", "true"),
+				taggedAt("latest", "v1"),
+			),
+		}, {
+			// Moving a tag elsewhere is detected, and the tag is pointed back.
+			PreConfig: func() {
+				img, err := random.Image(64, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := crane.Push(img, repo.Tag("latest").String()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			Config: config(`["latest", "v1"]`),
+			ConfigPlanChecks: resource.ConfigPlanChecks{
+				PreApply: []plancheck.PlanCheck{
+					plancheck.ExpectResourceAction("apko_build.foo", plancheck.ResourceActionUpdate),
+				},
+			},
+			Check: taggedAt("latest", "v1"),
+		}, {
+			// Removed tags are deleted, without rebuilding the image.
+			Config: config(`["v1", "v2"]`),
+			ConfigPlanChecks: resource.ConfigPlanChecks{
+				PreApply: []plancheck.PlanCheck{
+					plancheck.ExpectResourceAction("apko_build.foo", plancheck.ResourceActionUpdate),
+				},
+			},
+			Check: resource.ComposeTestCheckFunc(
+				taggedAt("v1", "v2"),
+				resource.TestCheckFunc(func(*terraform.State) error {
+					if _, err := crane.Digest(repo.Tag("latest").String()); err == nil {
+						return errors.New("latest was not deleted")
+					}
+					return nil
+				}),
+			),
+		}},
+	})
+}
+
+// TestAccResourceApkoBuild_MirrorRepos verifies that the image is published
+// to mirror_repos without being rebuilt.
+// TestAccResourceApkoBuild_EmbeddedCredentials builds from a config whose
+// repository and key URLs embed credentials, which are kept out of the
+// config and used from repository_auth instead.
+func TestAccResourceApkoBuild_EmbeddedCredentials(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	target, err := url.Parse("https://packages.wolfi.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &httputil.ReverseProxy{Rewrite: func(r *httputil.ProxyRequest) { r.SetURL(target) }}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, password, ok := req.BasicAuth(); !ok || user != "alice" || password != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req.Header.Del("Authorization")
+		proxy.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	config := func(auth string) string {
+		return fmt.Sprintf(`
+provider "apko" {
+  %s
+}
+
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  repositories:
+  - http://alice:s3cret@%[2]s/os
+  keyring:
+  - http://alice:s3cret@%[2]s/os/wolfi-signing.rsa.pub
+  packages:
+  - ca-certificates-bundle
+archs:
+- x86_64
+EOF
+}
+
+resource "apko_build" "foo" {
+  repo   = %[3]q
+  config = data.apko_config.foo.config
+}
+`, auth, host, repo.String())
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{{
+			Config:      config(""),
+			ExpectError: regexp.MustCompile(`repository_auth`),
+		}, {
+			Config: config(fmt.Sprintf(`repository_auth = {
+    %q = { username = "alice", password = "s3cret" }
+  }`, host)),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("data.apko_config.foo", "config.contents.repositories.0", "http://"+host+"/os"),
+				resource.TestCheckResourceAttr("data.apko_config.foo", "config.contents.keyring.0", "http://"+host+"/os/wolfi-signing.rsa.pub"),
+				resource.TestMatchResourceAttr("apko_build.foo", "image_ref", regexp.MustCompile("^"+repo.String()+"@sha256:")),
+			),
+		}},
+	})
+}
+
+func TestAccResourceApkoBuild_MirrorRepos(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+	mirror, cleanup := ocitesting.SetupRepository(t, "mirror")
+	defer cleanup()
+
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories:       []string{"https://packages.wolfi.dev/os"},
+				buildRespositories: []string{"./packages"},
+				keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:              []string{"x86_64"},
+				packages:           []string{"wolfi-baselayout=20230201-r24"},
+			}),
+		},
+		Steps: []resource.TestStep{{
+			Config: fmt.Sprintf(`
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+  - tzdata=2025b-r2
+EOF
+}
+
+resource "apko_build" "foo" {
+  repo         = %q
+  config       = data.apko_config.foo.config
+  mirror_repos = [%q]
+}
+`, repo.String(), mirror.String()),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("apko_build.foo", "mirror_refs.%", "1"),
 				resource.TestCheckFunc(func(s *terraform.State) error {
 					rs, ok := s.RootModule().Resources["apko_build.foo"]
 					if !ok {
 						return errors.New("apko_build.foo not in state")
 					}
-					p, err := layout.FromPath(layoutDir)
+					ref := rs.Primary.Attributes["mirror_refs."+mirror.String()]
+					d, err := crane.Digest(ref)
+					if err != nil {
+						return fmt.Errorf("crane.Digest(%s): %w", ref, err)
+					}
+					if got, want := mirror.Digest(d).String(), ref; got != want {
+						return fmt.Errorf("mirror digest %s != %s", got, want)
+					}
+					if want := repo.Digest(d).String(); rs.Primary.Attributes["image_ref"] != want {
+						return fmt.Errorf("image_ref %s != %s", rs.Primary.Attributes["image_ref"], want)
+					}
+					return nil
+				}),
+			),
+		}},
+	})
+}
+
+// TestAccResourceApkoBuild_VerifyReproducible verifies that a build with
+// locked packages passes the reproducibility check.
+func TestAccResourceApkoBuild_VerifyReproducible(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+
+	resource.Test(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories:       []string{"https://packages.wolfi.dev/os"},
+				buildRespositories: []string{"./packages"},
+				keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:              []string{"x86_64", "aarch64"},
+				packages:           []string{"wolfi-baselayout"},
+			}),
+		}, Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  packages:
+    - ca-certificates-bundle
+    - tzdata
+  EOF
+}
+
+resource "apko_build" "foo" {
+	repo                = %q
+	config              = data.apko_config.foo.config
+	configs             = data.apko_config.foo.configs
+	verify_reproducible = true
+}
+`, repostr),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestMatchResourceAttr(
+						"apko_build.foo", "image_ref", regexp.MustCompile("^"+repostr+"@sha256:")),
+					resource.TestCheckResourceAttr("apko_build.foo", "verify_reproducible", "true"),
+				),
+			},
+		},
+	})
+}
+
+// TestAccResourceApkoBuild_SourceDateEpoch verifies that an explicit
+// source_date_epoch overrides the build date derived from the packages.
+func TestAccResourceApkoBuild_SourceDateEpoch(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+
+	resource.Test(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories:       []string{"https://packages.wolfi.dev/os"},
+				buildRespositories: []string{"./packages"},
+				keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:              []string{"x86_64"},
+				packages:           []string{"wolfi-baselayout=20230201-r24"},
+			}),
+		},
+		Steps: []resource.TestStep{{
+			Config: fmt.Sprintf(`
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+  - tzdata=2025b-r2
+EOF
+}
+
+resource "apko_build" "foo" {
+  repo              = %q
+  config            = data.apko_config.foo.config
+  source_date_epoch = "1704067200"
+}
+`, repostr),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("apko_build.foo", "build_date", "2024-01-01T00:00:00Z"),
+				resource.TestCheckFunc(func(s *terraform.State) error {
+					rs, ok := s.RootModule().Resources["apko_build.foo"]
+					if !ok {
+						return errors.New("unable to find build resource foo")
+					}
+					img, err := crane.Pull(rs.Primary.Attributes["sboms.amd64.digest"])
 					if err != nil {
-						return fmt.Errorf("layout.FromPath(%q): %w", layoutDir, err)
+						return err
 					}
-					idx, err := p.ImageIndex()
+					cfg, err := img.ConfigFile()
 					if err != nil {
-						return fmt.Errorf("reading layout index: %w", err)
+						return err
+					}
+					if got, want := cfg.Created.UTC().Format(time.RFC3339), "2024-01-01T00:00:00Z"; got != want {
+						return fmt.Errorf("got created %s, wanted %s", got, want)
 					}
-					d, err := idx.Digest()
+
+					sbom, err := os.ReadFile(rs.Primary.Attributes["sboms.index.predicate_path"])
 					if err != nil {
-						return fmt.Errorf("layout digest: %w", err)
+						return err
 					}
-					want := rs.Primary.Attributes["image_ref"]
-					if got := repo.Digest(d.String()).String(); got != want {
-						return fmt.Errorf("layout digest %s != image_ref %s", got, want)
+					var doc spdx.Document
+					if err := json.Unmarshal(sbom, &doc); err != nil {
+						return err
+					}
+					if got, want := doc.CreationInfo.Created, "2024-01-01T00:00:00Z"; got != want {
+						return fmt.Errorf("got index sbom created %s, wanted %s", got, want)
 					}
 					return nil
 				}),
@@ -565,3 +1071,99 @@ resource "apko_build" "foo" {
 		}},
 	})
 }
+
+func TestAccResourceApkoBuild_BaseLayersFrom(t *testing.T) {
+	repo, cleanup := ocitesting.SetupRepository(t, "test")
+	defer cleanup()
+
+	repostr := repo.String()
+
+	resource.Test(t, resource.TestCase{
+		PreCheck: func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: map[string]func() (tfprotov6.ProviderServer, error){
+			"apko": providerserver.NewProtocol6WithError(&Provider{
+				repositories:       []string{"https://packages.wolfi.dev/os"},
+				buildRespositories: []string{"./packages"},
+				keyring:            []string{"https://packages.wolfi.dev/os/wolfi-signing.rsa.pub"},
+				archs:              []string{"x86_64"},
+				packages:           []string{"wolfi-baselayout=20230201-r24"},
+			}),
+		},
+		Steps: []resource.TestStep{{
+			Config: fmt.Sprintf(`
+data "apko_config" "base" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+EOF
+}
+
+resource "apko_build" "base" {
+  repo   = %q
+  config = data.apko_config.base.config
+}
+
+data "apko_config" "foo" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+  - tzdata=2025b-r2
+EOF
+}
+
+resource "apko_build" "foo" {
+  repo             = %q
+  config           = data.apko_config.foo.config
+  base_layers_from = { config = data.apko_config.base.config }
+}
+
+data "apko_config" "bar" {
+  config_contents = <<EOF
+contents:
+  packages:
+  - ca-certificates-bundle=20250911-r0
+  - glibc-locale-posix=2.42-r2
+EOF
+}
+
+resource "apko_build" "bar" {
+  repo             = %q
+  config           = data.apko_config.bar.config
+  base_layers_from = { image_ref = apko_build.base.image_ref }
+}
+`, repostr, repostr, repostr),
+			Check: resource.TestCheckFunc(func(s *terraform.State) error {
+				var first []v1.Hash
+				for _, name := range []string{"foo", "bar"} {
+					rs, ok := s.RootModule().Resources["apko_build."+name]
+					if !ok {
+						return fmt.Errorf("unable to find build resource %s", name)
+					}
+					img, err := crane.Pull(rs.Primary.Attributes["sboms.amd64.digest"])
+					if err != nil {
+						return err
+					}
+					layers, err := img.Layers()
+					if err != nil {
+						return err
+					}
+					// The shared layer, one for the other package, and the top layer.
+					if got, want := len(layers), 3; got != want {
+						return fmt.Errorf("%s: got %d layers, wanted %d", name, got, want)
+					}
+					d, err := layers[0].Digest()
+					if err != nil {
+						return err
+					}
+					first = append(first, d)
+				}
+				if first[0] != first[1] {
+					return fmt.Errorf("leading layers differ: %s != %s", first[0], first[1])
+				}
+				return nil
+			}),
+		}},
+	})
+}
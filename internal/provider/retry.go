@@ -2,9 +2,14 @@ package provider
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"io"
+	"net/http"
+	"slices"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -15,18 +20,169 @@ var longBackoff = wait.Backoff{
 	Steps:    3,
 }
 
+type RetryConfig struct {
+	Attempts     *int64   `tfsdk:"attempts"`
+	InitialDelay *string  `tfsdk:"initial_delay"`
+	MaxDelay     *string  `tfsdk:"max_delay"`
+	Jitter       *float64 `tfsdk:"jitter"`
+}
+
+// backoff returns the retry policy configured by cfg, with longBackoff's
+// values for anything unset. Its Cap is the max_delay, which retry applies to
+// each delay.
+func (cfg *RetryConfig) backoff() wait.Backoff {
+	b := longBackoff
+	if cfg == nil {
+		return b
+	}
+	if cfg.Attempts != nil {
+		b.Steps = int(*cfg.Attempts)
+	}
+	// The durations are validated by the schema.
+	if cfg.InitialDelay != nil {
+		b.Duration, _ = time.ParseDuration(*cfg.InitialDelay)
+	}
+	if cfg.MaxDelay != nil {
+		b.Cap, _ = time.ParseDuration(*cfg.MaxDelay)
+	}
+	if cfg.Jitter != nil {
+		b.Jitter = *cfg.Jitter
+	}
+	return b
+}
+
+// retryBackoff returns the provider's retry policy.
+func (p ProviderOpts) retryBackoff() wait.Backoff {
+	if p.backoff.Steps == 0 {
+		return longBackoff
+	}
+	return p.backoff
+}
+
+// failFastCodes are the registry error codes that retrying won't fix.
+var failFastCodes = []transport.ErrorCode{
+	transport.UnauthorizedErrorCode,
+	transport.DeniedErrorCode,
+	transport.ManifestInvalidErrorCode,
+	transport.ManifestBlobUnknownErrorCode,
+	transport.ManifestUnverifiedErrorCode,
+	transport.NameInvalidErrorCode,
+	transport.TagInvalidErrorCode,
+	transport.DigestInvalidErrorCode,
+	transport.SizeInvalidErrorCode,
+	transport.UnsupportedErrorCode,
+}
+
+// retryable reports whether err may go away by trying again, which isn't the
+// case for cancellation, authentication and authorization failures, invalid
+// manifests or untrusted certificates.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if _, ok := errors.AsType[*tls.CertificateVerificationError](err); ok {
+		return false
+	}
+	terr, ok := errors.AsType[*transport.Error](err)
+	if !ok {
+		return true
+	}
+	if terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden {
+		return false
+	}
+	for _, d := range terr.Errors {
+		if slices.Contains(failFastCodes, d.Code) {
+			return false
+		}
+	}
+	return true
+}
+
+// retry calls f until it succeeds, it fails with an error that isn't
+// retryable, or backoff.Steps attempts have been made. Unlike
+// wait.ExponentialBackoff, backoff.Cap limits each delay rather than ending
+// the retries early.
 func retry(ctx context.Context, backoff wait.Backoff, f func(context.Context) error) error {
+	attempts, maxDelay := backoff.Steps, backoff.Cap
+	backoff.Cap = 0
+
 	errs := []error{}
-	if err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+	for attempt := 1; ; attempt++ {
 		err := f(ctx)
+		if err == nil {
+			return nil
+		}
 		errs = append(errs, err)
+		if !retryable(err) {
+			return errors.Join(errs...)
+		}
+		if attempt >= attempts {
+			errs = append(errs, wait.ErrWaitTimeout)
+			return errors.Join(errs...)
+		}
+		if err := sleep(ctx, nextDelay(&backoff, maxDelay)); err != nil {
+			errs = append(errs, err)
+			return errors.Join(errs...)
+		}
+	}
+}
 
-		return err == nil, nil
-	}); err != nil {
-		errs = append(errs, err)
+// nextDelay steps backoff, limiting the delay to maxDelay if it is set.
+func nextDelay(backoff *wait.Backoff, maxDelay time.Duration) time.Duration {
+	d := backoff.Step()
+	if maxDelay > 0 && d > maxDelay {
+		d = maxDelay
+	}
+	return d
+}
 
-		return errors.Join(errs...)
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryTransport retries the GET and HEAD requests to package repositories
+// that fail with network errors, 429 or 5xx responses. Other responses,
+// including 401 and 403, are returned as they are.
+type retryTransport struct {
+	backoff wait.Backoff
+	inner   http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead || req.Body != nil && req.Body != http.NoBody {
+		return t.inner.RoundTrip(req)
 	}
 
-	return nil
+	backoff := t.backoff
+	attempts, maxDelay := backoff.Steps, backoff.Cap
+	backoff.Cap = 0
+	for attempt := 1; ; attempt++ {
+		resp, err := t.inner.RoundTrip(req)
+		if attempt >= attempts || !retryableResponse(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain some of the body, so that the connection can be reused.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), nextDelay(&backoff, maxDelay)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func retryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return retryable(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented
 }
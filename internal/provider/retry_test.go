@@ -4,9 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -81,3 +87,154 @@ func TestRetry(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryFailFast(t *testing.T) {
+	shortBackoff := wait.Backoff{
+		Duration: 1 * time.Millisecond,
+		Factor:   1.0,
+		Steps:    3,
+	}
+
+	for _, tc := range []struct {
+		name  string
+		err   error
+		calls int
+	}{{
+		name:  "transient",
+		err:   &transport.Error{StatusCode: http.StatusServiceUnavailable},
+		calls: 3,
+	}, {
+		name:  "unauthorized",
+		err:   &transport.Error{StatusCode: http.StatusUnauthorized},
+		calls: 1,
+	}, {
+		name:  "forbidden",
+		err:   fmt.Errorf("pushing: %w", &transport.Error{StatusCode: http.StatusForbidden}),
+		calls: 1,
+	}, {
+		name: "manifest invalid",
+		err: &transport.Error{
+			StatusCode: http.StatusBadRequest,
+			Errors:     []transport.Diagnostic{{Code: transport.ManifestInvalidErrorCode}},
+		},
+		calls: 1,
+	}, {
+		name:  "canceled",
+		err:   context.Canceled,
+		calls: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := retry(context.Background(), shortBackoff, func(context.Context) error {
+				calls++
+				return tc.err
+			})
+			if !errors.Is(err, tc.err) {
+				t.Errorf("wanted %v got %v", tc.err, err)
+			}
+			if calls != tc.calls {
+				t.Errorf("called %d times, wanted %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestRetryConfig(t *testing.T) {
+	var cfg *RetryConfig
+	if got := cfg.backoff(); got != longBackoff {
+		t.Errorf("unset: got %+v, wanted %+v", got, longBackoff)
+	}
+
+	attempts, initial, maxDelay, jitter := int64(5), "10ms", "30ms", 0.0
+	cfg = &RetryConfig{Attempts: &attempts, InitialDelay: &initial, MaxDelay: &maxDelay, Jitter: &jitter}
+	backoff := cfg.backoff()
+	if backoff.Steps != 5 {
+		t.Errorf("Steps = %d, wanted 5", backoff.Steps)
+	}
+
+	// The delays double up to max_delay, without ending the retries.
+	b := backoff
+	b.Cap = 0
+	var delays []time.Duration
+	for range backoff.Steps - 1 {
+		delays = append(delays, nextDelay(&b, backoff.Cap))
+	}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays = %v, wanted %v", delays, want)
+	}
+
+	calls := 0
+	if err := retry(context.Background(), backoff, func(context.Context) error {
+		calls++
+		return errors.New("transient")
+	}); err == nil {
+		t.Error("expected an error")
+	}
+	if calls != 5 {
+		t.Errorf("called %d times, wanted 5", calls)
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		want     int
+		requests int
+	}{{
+		name:     "recovers",
+		statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+		want:     http.StatusOK,
+		requests: 3,
+	}, {
+		name:     "exhausted",
+		statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK},
+		want:     http.StatusBadGateway,
+		requests: 3,
+	}, {
+		name:     "unauthorized",
+		statuses: []int{http.StatusUnauthorized, http.StatusOK},
+		want:     http.StatusUnauthorized,
+		requests: 1,
+	}, {
+		name:     "not found",
+		statuses: []int{http.StatusNotFound, http.StatusOK},
+		want:     http.StatusNotFound,
+		requests: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+				w.WriteHeader(tc.statuses[n-1])
+				fmt.Fprintf(w, "response %d", n)
+			}))
+			defer srv.Close()
+
+			client := &http.Client{Transport: &retryTransport{
+				backoff: wait.Backoff{Duration: time.Millisecond, Factor: 1.0, Steps: 3},
+				inner:   http.DefaultTransport,
+			}}
+			resp, err := client.Get(srv.URL + "/x86_64/APKINDEX.tar.gz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tc.want {
+				t.Errorf("status = %d, wanted %d", resp.StatusCode, tc.want)
+			}
+			if got := requests.Load(); got != int64(tc.requests) {
+				t.Errorf("made %d requests, wanted %d", got, tc.requests)
+			}
+			if want := fmt.Sprintf("response %d", tc.requests); string(body) != want {
+				t.Errorf("body = %q, wanted %q", body, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package provider
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	apkotypes "chainguard.dev/apko/pkg/build/types"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// rootfsManifestSuffix is appended to rootfs_path to name the manifest that
+// records the ownership and permissions of the files in the root filesystem.
+const rootfsManifestSuffix = ".manifest.json"
+
+// rootfsManifest describes the root filesystem written to rootfs_path.
+type rootfsManifest struct {
+	Arch    string        `json:"arch"`
+	Image   string        `json:"image"`
+	Entries []rootfsEntry `json:"entries"`
+}
+
+// rootfsEntry is the metadata of a file in the root filesystem, which a
+// directory written without privileges can't carry.
+type rootfsEntry struct {
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Mode     string            `json:"mode"`
+	UID      int               `json:"uid"`
+	GID      int               `json:"gid"`
+	Size     int64             `json:"size,omitempty"`
+	Linkname string            `json:"linkname,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+}
+
+var rootfsTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+func newRootFSEntry(hdr *tar.Header) rootfsEntry {
+	e := rootfsEntry{
+		Path:     hdr.Name,
+		Type:     rootfsTypes[hdr.Typeflag],
+		Mode:     fmt.Sprintf("%04o", hdr.Mode&0o7777),
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Linkname: hdr.Linkname,
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		e.Size = hdr.Size
+	}
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if e.Xattrs == nil {
+				e.Xattrs = map[string]string{}
+			}
+			e.Xattrs[name] = v
+		}
+	}
+	return e
+}
+
+// rootfsImage returns the image of idx for arch or, if arch is empty, for the
+// only architecture of idx or else the host's.
+func rootfsImage(idx v1.ImageIndex, arch string) (apkotypes.Architecture, v1.Image, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return "", nil, err
+	}
+	byArch := map[apkotypes.Architecture]v1.Hash{}
+	for _, desc := range im.Manifests {
+		if desc.Platform == nil || !desc.MediaType.IsImage() {
+			continue
+		}
+		byArch[platformArchitecture(desc.Platform)] = desc.Digest
+	}
+
+	var want apkotypes.Architecture
+	switch {
+	case arch != "":
+		want = apkotypes.ParseArchitecture(arch)
+	case len(byArch) == 1:
+		for a := range byArch {
+			want = a
+		}
+	default:
+		want = apkotypes.ParseArchitecture(runtime.GOARCH)
+	}
+	h, ok := byArch[want]
+	if !ok {
+		var archs []string
+		for a := range byArch {
+			archs = append(archs, a.ToAPK())
+		}
+		slices.Sort(archs)
+		return "", nil, fmt.Errorf("the image has no %s architecture, set rootfs_arch to one of %s", want.ToAPK(), strings.Join(archs, ", "))
+	}
+	img, err := idx.Image(h)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading %s image: %w", want, err)
+	}
+	return want, img, nil
+}
+
+// writeRootFS writes the flattened filesystem of img to p, as a tar file if p
+// ends in .tar and otherwise as a directory, along with its manifest. A
+// directory only replaces one that was written by writeRootFS before, which is
+// known by its manifest.
+func writeRootFS(p string, img v1.Image, arch apkotypes.Architecture) error {
+	h, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	var sink rootfsSink
+	if strings.HasSuffix(p, ".tar") {
+		sink, err = newTarRootFS(p)
+	} else {
+		sink, err = newDirRootFS(p)
+	}
+	if err != nil {
+		return err
+	}
+	defer sink.abort()
+
+	m := rootfsManifest{Arch: arch.ToAPK(), Image: h.String(), Entries: []rootfsEntry{}}
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	// The flattened layers come top layer first, so hard links can come
+	// before what they link to.
+	var links []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading image filesystem: %w", err)
+		}
+		hdr.Name = path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if hdr.Name == "." || hdr.Name == ".." || strings.HasPrefix(hdr.Name, "../") {
+			continue
+		}
+		m.Entries = append(m.Entries, newRootFSEntry(hdr))
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))
+			links = append(links, hdr)
+			continue
+		}
+		if err := sink.add(hdr, tr); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+	for _, hdr := range links {
+		if err := sink.add(hdr, nil); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+	if err := sink.commit(); err != nil {
+		return err
+	}
+
+	slices.SortFunc(m.Entries, func(a, b rootfsEntry) int { return strings.Compare(a.Path, b.Path) })
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p+rootfsManifestSuffix, b, 0o644)
+}
+
+// rootfsSink is where writeRootFS writes the files of the root filesystem.
+// Nothing is visible at the destination until commit, and abort cleans up
+// anything that wasn't committed.
+type rootfsSink interface {
+	add(hdr *tar.Header, r io.Reader) error
+	commit() error
+	abort()
+}
+
+// tarRootFS writes the root filesystem as a tar file.
+type tarRootFS struct {
+	dest string
+	f    *os.File
+	tw   *tar.Writer
+}
+
+func newTarRootFS(p string) (*tarRootFS, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &tarRootFS{dest: p, f: f, tw: tar.NewWriter(f)}, nil
+}
+
+func (t *tarRootFS) add(hdr *tar.Header, r io.Reader) error {
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r == nil || hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(t.tw, r)
+	return err
+}
+
+func (t *tarRootFS) commit() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if err := t.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(t.f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(t.f.Name(), t.dest)
+}
+
+func (t *tarRootFS) abort() {
+	t.f.Close()
+	os.Remove(t.f.Name())
+}
+
+// dirRootFS writes the root filesystem to a directory. Ownership is only
+// applied when running as root, and device nodes aren't created, but both are
+// recorded in the manifest.
+type dirRootFS struct {
+	dest, tmp string
+	root      *os.Root
+	// The directories, whose permissions are applied last, so that
+	// read-only ones can be filled in.
+	dirs []*tar.Header
+}
+
+func newDirRootFS(p string) (*dirRootFS, error) {
+	if err := checkRootFSDir(p); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(p), "."+filepath.Base(p)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	return &dirRootFS{dest: p, tmp: tmp, root: root}, nil
+}
+
+// checkRootFSDir makes sure that writing the root filesystem to p won't
+// replace a directory of something else.
+func checkRootFSDir(p string) error {
+	entries, err := os.ReadDir(p)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && len(entries) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p + rootfsManifestSuffix); err != nil {
+		return fmt.Errorf("%s isn't empty, and doesn't have the %s that apko_build writes with a root filesystem", p, filepath.Base(p+rootfsManifestSuffix))
+	}
+	return nil
+}
+
+func (d *dirRootFS) add(hdr *tar.Header, r io.Reader) error {
+	name := hdr.Name
+	if dir := path.Dir(name); dir != "." {
+		if err := d.root.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := d.root.MkdirAll(name, 0o755); err != nil {
+			return err
+		}
+		d.dirs = append(d.dirs, hdr)
+		return nil
+	case tar.TypeReg:
+		f, err := d.root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := d.root.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+		return d.chown(hdr)
+	case tar.TypeLink:
+		return d.root.Link(hdr.Linkname, name)
+	default:
+		// Device nodes and FIFOs are only recorded in the manifest.
+		return nil
+	}
+	return d.setMetadata(hdr)
+}
+
+func (d *dirRootFS) chown(hdr *tar.Header) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return d.root.Lchown(hdr.Name, hdr.Uid, hdr.Gid)
+}
+
+func (d *dirRootFS) setMetadata(hdr *tar.Header) error {
+	if err := d.chown(hdr); err != nil {
+		return err
+	}
+	mode := hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if err := d.root.Chmod(hdr.Name, mode); err != nil {
+		return err
+	}
+	return d.root.Chtimes(hdr.Name, hdr.ModTime, hdr.ModTime)
+}
+
+func (d *dirRootFS) commit() error {
+	// Deepest first, so that the times of the parents stick.
+	slices.SortFunc(d.dirs, func(a, b *tar.Header) int { return strings.Compare(b.Name, a.Name) })
+	for _, hdr := range d.dirs {
+		if err := d.setMetadata(hdr); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+	if err := d.root.Close(); err != nil {
+		return err
+	}
+	if err := removeRootFS(d.dest); err != nil {
+		return err
+	}
+	if err := os.Chmod(d.tmp, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(d.tmp, d.dest)
+}
+
+func (d *dirRootFS) abort() {
+	d.root.Close()
+	if _, err := os.Stat(d.tmp); err == nil {
+		_ = removeRootFS(d.tmp)
+	}
+}
+
+// removeRootFS removes a root filesystem directory, making its read-only
+// directories writable first.
+func removeRootFS(p string) error {
+	err := filepath.WalkDir(p, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return os.Chmod(p, 0o700)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// writeRootFS writes the root filesystem of the image in idx to rootfs_path,
+// if it is set.
+func (data *BuildResourceModel) writeRootFS(idx v1.ImageIndex) error {
+	p := data.RootFSPath.ValueString()
+	if p == "" {
+		return nil
+	}
+	arch, img, err := rootfsImage(idx, data.RootFSArch.ValueString())
+	if err != nil {
+		return err
+	}
+	if err := writeRootFS(p, img, arch); err != nil {
+		return fmt.Errorf("writing %s root filesystem to %s: %w", arch.ToAPK(), p, err)
+	}
+	return nil
+}
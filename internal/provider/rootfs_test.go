@@ -0,0 +1,243 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// tarLayer returns a layer of the given files, with the contents of regular
+// files taken from contents.
+func tarLayer(t *testing.T, hdrs []tar.Header, contents map[string]string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.Size = int64(len(contents[hdr.Name]))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func rootfsTestImage(t *testing.T) v1.Image {
+	t.Helper()
+	base := tarLayer(t, []tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "etc/gone", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/busybox", Typeflag: tar.TypeReg, Mode: 0o4755, Uid: 0, Gid: 0},
+	}, map[string]string{
+		"etc/passwd":      "root:x:0:0::/root:/bin/sh\n",
+		"etc/gone":        "removed by the next layer",
+		"usr/bin/busybox": "busybox",
+	})
+	top := tarLayer(t, []tar.Header{
+		{Name: "etc/.wh.gone", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "home/", Typeflag: tar.TypeDir, Mode: 0o750, Uid: 65532, Gid: 65532},
+		{Name: "home/nonroot/", Typeflag: tar.TypeDir, Mode: 0o500, Uid: 65532, Gid: 65532},
+		{Name: "home/nonroot/data", Typeflag: tar.TypeReg, Mode: 0o600, Uid: 65532, Gid: 65532, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "yes"}},
+		{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"},
+		{Name: "usr/bin/ls", Typeflag: tar.TypeLink, Linkname: "usr/bin/busybox"},
+	}, map[string]string{
+		"home/nonroot/data": "data",
+	})
+	img, err := mutate.AppendLayers(empty.Image, base, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func readRootFSManifest(t *testing.T, p string) rootfsManifest {
+	t.Helper()
+	b, err := os.ReadFile(p + rootfsManifestSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m rootfsManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWriteRootFS(t *testing.T) {
+	img := rootfsTestImage(t)
+
+	t.Run("dir", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "rootfs")
+		t.Cleanup(func() { _ = removeRootFS(p) })
+		for range 2 {
+			// Writing it again replaces it.
+			if err := writeRootFS(p, img, "x86_64"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if b, err := os.ReadFile(filepath.Join(p, "etc/passwd")); err != nil || string(b) != "root:x:0:0::/root:/bin/sh\n" {
+			t.Errorf("etc/passwd = %q, %v", b, err)
+		}
+		if _, err := os.Lstat(filepath.Join(p, "etc/gone")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected the whiteout to remove etc/gone, got %v", err)
+		}
+		if target, err := os.Readlink(filepath.Join(p, "usr/bin/sh")); err != nil || target != "busybox" {
+			t.Errorf("usr/bin/sh -> %q, %v", target, err)
+		}
+		busybox, err := os.Stat(filepath.Join(p, "usr/bin/busybox"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := busybox.Mode(), fs.ModeSetuid|0o755; got != want {
+			t.Errorf("usr/bin/busybox mode = %v, wanted %v", got, want)
+		}
+		ls, err := os.Stat(filepath.Join(p, "usr/bin/ls"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(busybox, ls) {
+			t.Error("expected usr/bin/ls to be a hard link to usr/bin/busybox")
+		}
+		if fi, err := os.Stat(filepath.Join(p, "home/nonroot")); err != nil || fi.Mode().Perm() != 0o500 {
+			t.Errorf("home/nonroot = %v, %v", fi, err)
+		}
+
+		m := readRootFSManifest(t, p)
+		if m.Arch != "x86_64" {
+			t.Errorf("arch = %s", m.Arch)
+		}
+		if h, _ := img.Digest(); m.Image != h.String() {
+			t.Errorf("image = %s, wanted %s", m.Image, h)
+		}
+		i := slices.IndexFunc(m.Entries, func(e rootfsEntry) bool { return e.Path == "home/nonroot/data" })
+		if i < 0 {
+			t.Fatalf("home/nonroot/data not in %v", m.Entries)
+		}
+		if got, want := m.Entries[i], (rootfsEntry{Path: "home/nonroot/data", Type: "file", Mode: "0600", UID: 65532, GID: 65532, Size: 4, Xattrs: map[string]string{"user.test": "yes"}}); !reflect.DeepEqual(got, want) {
+			t.Errorf("home/nonroot/data = %+v, wanted %+v", got, want)
+		}
+		if !slices.IsSortedFunc(m.Entries, func(a, b rootfsEntry) int { return strings.Compare(a.Path, b.Path) }) {
+			t.Error("expected the manifest to be sorted by path")
+		}
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "rootfs.tar")
+		if err := writeRootFS(p, img, "aarch64"); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tr := tar.NewReader(f)
+		got := map[string]*tar.Header{}
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got[hdr.Name] = hdr
+		}
+		if _, ok := got["etc/gone"]; ok {
+			t.Error("expected the whiteout to remove etc/gone")
+		}
+		if hdr, ok := got["home/nonroot/data"]; !ok || hdr.Uid != 65532 || hdr.Mode != 0o600 {
+			t.Errorf("home/nonroot/data = %+v", hdr)
+		}
+		if hdr, ok := got["usr/bin/ls"]; !ok || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "usr/bin/busybox" {
+			t.Errorf("usr/bin/ls = %+v", hdr)
+		}
+		if m := readRootFSManifest(t, p); m.Arch != "aarch64" || len(m.Entries) != len(got) {
+			t.Errorf("manifest has %d entries for %s, wanted %d for aarch64", len(m.Entries), m.Arch, len(got))
+		}
+	})
+
+	t.Run("foreign dir", func(t *testing.T) {
+		p := t.TempDir()
+		if err := os.WriteFile(filepath.Join(p, "keep"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeRootFS(p, img, "x86_64"); err == nil {
+			t.Error("expected writing over a directory of something else to fail")
+		}
+		if _, err := os.Stat(filepath.Join(p, "keep")); err != nil {
+			t.Errorf("expected the directory to be left alone: %v", err)
+		}
+	})
+}
+
+func TestRootFSImage(t *testing.T) {
+	img := rootfsTestImage(t)
+	one := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+	})
+	two := mutate.AppendManifests(one, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "riscv64"}},
+	})
+
+	for _, tc := range []struct {
+		name    string
+		idx     v1.ImageIndex
+		arch    string
+		want    string
+		wantErr bool
+	}{
+		{name: "only architecture", idx: one, want: "aarch64"},
+		{name: "chosen apk architecture", idx: two, arch: "riscv64", want: "riscv64"},
+		{name: "chosen oci architecture", idx: two, arch: "arm64", want: "aarch64"},
+		{name: "missing architecture", idx: two, arch: "x86_64", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			arch, _, err := rootfsImage(tc.idx, tc.arch)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", arch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if arch.ToAPK() != tc.want {
+				t.Errorf("arch = %s, wanted %s", arch.ToAPK(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// tagRegexp matches the tags allowed by the OCI distribution spec.
+var tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// tagList returns the tags of a set, sorted.
+func tagList(ctx context.Context, set types.Set) ([]string, error) {
+	if set.IsNull() || set.IsUnknown() {
+		return nil, nil
+	}
+	var tags []string
+	if diags := set.ElementsAs(ctx, &tags, false); diags.HasError() {
+		return nil, fmt.Errorf("reading tags: %v", diags.Errors())
+	}
+	slices.Sort(tags)
+	return tags, nil
+}
+
+// pushTags points each of tags in repo at t.
+func (p ProviderOpts) pushTags(ctx context.Context, repo name.Repository, tags []string, t remote.Taggable) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	pusher, err := remote.NewPusher(p.ropts...)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		ref := repo.Tag(tag)
+		if err := retry(ctx, p.retryBackoff(), func(ctx context.Context) error {
+			return pusher.Push(ctx, ref, t)
+		}); err != nil {
+			return fmt.Errorf("tagging %s: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// retag points each of tags in repo at the image dig, which has already been
+// pushed.
+func (p ProviderOpts) retag(ctx context.Context, dig name.Digest, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	desc, err := remote.Get(dig, append(p.ropts, remote.WithContext(ctx))...)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", dig, err)
+	}
+	return p.pushTags(ctx, dig.Repository, tags, desc)
+}
+
+// taggedAt returns which of tags in repo currently point at the image dig.
+func (p ProviderOpts) taggedAt(ctx context.Context, dig name.Digest, tags []string) ([]string, error) {
+	var current []string
+	for _, tag := range tags {
+		ref := dig.Repository.Tag(tag)
+		desc, err := remote.Head(ref, append(p.ropts, remote.WithContext(ctx))...)
+		if terr, ok := errors.AsType[*transport.Error](err); ok && terr.StatusCode == http.StatusNotFound {
+			tflog.Warn(ctx, fmt.Sprintf("%s no longer exists", ref))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("checking %s: %w", ref, err)
+		}
+		if desc.Digest.String() != dig.DigestStr() {
+			tflog.Warn(ctx, fmt.Sprintf("%s has moved to %s", ref, desc.Digest))
+			continue
+		}
+		current = append(current, tag)
+	}
+	return current, nil
+}
+
+// untag deletes those of tags in repo that still point at the image dig,
+// leaving those that have been moved to other images.
+func (p ProviderOpts) untag(ctx context.Context, dig name.Digest, tags []string) error {
+	current, err := p.taggedAt(ctx, dig, tags)
+	if err != nil {
+		return err
+	}
+	for _, tag := range current {
+		ref := dig.Repository.Tag(tag)
+		if err := remote.Delete(ref, append(p.ropts, remote.WithContext(ctx))...); err != nil {
+			return fmt.Errorf("deleting %s: %w", ref, err)
+		}
+	}
+	return nil
+}
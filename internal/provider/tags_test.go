@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dig := repo.Digest(h.String())
+	if err := remote.WriteIndex(dig, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	var popts ProviderOpts
+	if err := popts.retag(ctx, dig, []string{"latest", "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	current, err := popts.taggedAt(ctx, dig, []string{"latest", "missing", "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"latest", "v1"}; !slices.Equal(current, want) {
+		t.Errorf("taggedAt() = %v, wanted %v", current, want)
+	}
+
+	// Move v1 to another image.
+	other, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Tag("v1"), other); err != nil {
+		t.Fatal(err)
+	}
+	current, err = popts.taggedAt(ctx, dig, []string{"latest", "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"latest"}; !slices.Equal(current, want) {
+		t.Errorf("taggedAt() = %v, wanted %v", current, want)
+	}
+
+	// Only the tag that still points at the image is deleted.
+	if err := popts.untag(ctx, dig, []string{"latest", "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Head(repo.Tag("latest")); err == nil {
+		t.Error("latest was not deleted")
+	}
+	desc, err := remote.Head(repo.Tag("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oh, err := other.Digest(); err != nil {
+		t.Fatal(err)
+	} else if desc.Digest != oh {
+		t.Errorf("v1 points at %s, wanted %s", desc.Digest, oh)
+	}
+}
+
+func TestTagRegexp(t *testing.T) {
+	for _, tag := range []string{"latest", "v1.2.3", "1.2_3-rc.1", "_x"} {
+		if !tagRegexp.MatchString(tag) {
+			t.Errorf("%q should be a valid tag", tag)
+		}
+	}
+	for _, tag := range []string{"", ".x", "-x", "a:b", "a/b", strings.Repeat("x", 129)} {
+		if tagRegexp.MatchString(tag) {
+			t.Errorf("%q should not be a valid tag", tag)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+var imageTarballSchema = basetypes.ObjectType{
+	AttrTypes: map[string]attr.Type{
+		"path":   basetypes.StringType{},
+		"sha256": basetypes.StringType{},
+	},
+}
+
+// writeImageTarballs writes each image of idx to dir as a docker-archive
+// tarball named after its APK architecture, tagged as tag, and returns their
+// paths and SHA256s by architecture.
+func writeImageTarballs(dir string, idx v1.ImageIndex, tag name.Tag) (types.Map, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return types.Map{}, fmt.Errorf("create image tarballs dir %q: %w", dir, err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return types.Map{}, err
+	}
+
+	tarballs := make(map[string]attr.Value, len(im.Manifests))
+	for _, desc := range im.Manifests {
+		if desc.Platform == nil || !desc.MediaType.IsImage() {
+			continue
+		}
+		arch := platformArchitecture(desc.Platform)
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return types.Map{}, fmt.Errorf("reading %s image: %w", arch, err)
+		}
+		p := filepath.Join(dir, arch.ToAPK()+".tar")
+		sum, err := writeImageTarball(p, img, tag)
+		if err != nil {
+			return types.Map{}, fmt.Errorf("writing %s image tarball: %w", arch, err)
+		}
+		v, diags := types.ObjectValue(imageTarballSchema.AttrTypes, map[string]attr.Value{
+			"path":   types.StringValue(p),
+			"sha256": types.StringValue(sum),
+		})
+		if diags.HasError() {
+			return types.Map{}, fmt.Errorf("%v", diags.Errors())
+		}
+		tarballs[arch.String()] = v
+	}
+	v, diags := types.MapValue(imageTarballSchema, tarballs)
+	if diags.HasError() {
+		return types.Map{}, fmt.Errorf("%v", diags.Errors())
+	}
+	return v, nil
+}
+
+// writeImageTarball writes img to p, returning the hex SHA256 of the tarball.
+func writeImageTarball(p string, img v1.Image, tag name.Tag) (string, error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if err := tarball.Write(tag, img, io.MultiWriter(f, h)); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeImageTarballs writes the images of idx to image_tarballs_dir, if it is
+// set, tagged with the first of tags, or "latest", and sets image_tarballs.
+func (data *BuildResourceModel) writeImageTarballs(ctx context.Context, repo name.Repository, idx v1.ImageIndex) error {
+	dir := data.ImageTarballsDir.ValueString()
+	if dir == "" {
+		data.ImageTarballs = types.MapNull(imageTarballSchema)
+		return nil
+	}
+	tag, err := data.imageTag(ctx, repo)
+	if err != nil {
+		return err
+	}
+	data.ImageTarballs, err = writeImageTarballs(dir, idx, tag)
+	return err
+}
+
+// imageTag returns the tag that names the image in the files written for it,
+// which is the first of tags in repo, or latest.
+func (data *BuildResourceModel) imageTag(ctx context.Context, repo name.Repository) (name.Tag, error) {
+	tags, err := tagList(ctx, data.Tags)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	tag := "latest"
+	if len(tags) != 0 {
+		tag = tags[0]
+	}
+	return repo.Tag(tag), nil
+}
@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestWriteImageTarballs(t *testing.T) {
+	platforms := map[string]v1.Platform{
+		"x86_64":  {OS: "linux", Architecture: "amd64"},
+		"aarch64": {OS: "linux", Architecture: "arm64"},
+		"armv7":   {OS: "linux", Architecture: "arm", Variant: "v7"},
+	}
+	digests := map[string]v1.Hash{}
+	var idx v1.ImageIndex = empty.Index
+	for apkArch, p := range platforms {
+		img, err := random.Image(256, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digests[apkArch], err = img.Digest(); err != nil {
+			t.Fatal(err)
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &p},
+		})
+	}
+
+	dir := filepath.Join(t.TempDir(), "tarballs")
+	tag, err := name.NewTag("example.com/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarballs, err := writeImageTarballs(dir, idx, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, apkArch := range map[string]string{"amd64": "x86_64", "arm64": "aarch64", "arm/v7": "armv7"} {
+		obj, ok := tarballs.Elements()[key].(types.Object)
+		if !ok {
+			t.Fatalf("no tarball for %s in %v", key, tarballs)
+		}
+		p, ok := obj.Attributes()["path"].(types.String)
+		if !ok {
+			t.Fatalf("%s: no path", key)
+		}
+		sum, ok := obj.Attributes()["sha256"].(types.String)
+		if !ok {
+			t.Fatalf("%s: no sha256", key)
+		}
+		if want := filepath.Join(dir, apkArch+".tar"); p.ValueString() != want {
+			t.Errorf("%s: path = %s, wanted %s", key, p.ValueString(), want)
+		}
+
+		content, err := os.ReadFile(p.ValueString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := sha256.Sum256(content); sum.ValueString() != hex.EncodeToString(h[:]) {
+			t.Errorf("%s: sha256 = %s, wanted %s", key, sum.ValueString(), hex.EncodeToString(h[:]))
+		}
+
+		img, err := tarball.ImageFromPath(p.ValueString(), &tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != digests[apkArch] {
+			t.Errorf("%s: tarball image digest = %s, wanted %s", key, got, digests[apkArch])
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	name = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func tlsGet(rt http.RoundTripper, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+func TestTLSTransport(t *testing.T) {
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	srv := httptest.NewTLSServer(ok)
+	defer srv.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	str := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		name    string
+		cfg     TLSConfig
+		wantErr bool
+	}{
+		{"untrusted", TLSConfig{}, true},
+		{"ca_bundle", TLSConfig{CABundle: str(ca)}, false},
+		{"insecure_hosts", TLSConfig{InsecureHosts: []string{srv.Listener.Addr().String()}}, false},
+		{"other insecure host", TLSConfig{InsecureHosts: []string{"example.com"}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt, err := tc.cfg.transport(http.DefaultTransport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tlsGet(rt, srv.URL); (err != nil) != tc.wantErr {
+				t.Errorf("GET = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := (&TLSConfig{CABundle: str(filepath.Join(t.TempDir(), "missing.pem"))}).transport(http.DefaultTransport); err == nil {
+		t.Error("transport() with a missing ca_bundle = nil, want an error")
+	}
+}
+
+func TestTLSTransportPlainHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	host := srv.Listener.Addr().String()
+	rt, err := (&TLSConfig{PlainHTTPHosts: []string{host}}).transport(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsGet(rt, "https://"+host+"/v2/"); err != nil {
+		t.Errorf("GET = %v, want it to be sent over plain HTTP", err)
+	}
+}
+
+func TestTLSTransportClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	str := func(s string) *string { return &s }
+	without, err := (&TLSConfig{CABundle: str(ca)}).transport(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsGet(without, srv.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("GET without a client certificate = %v, want a certificate error", err)
+	}
+
+	with, err := (&TLSConfig{
+		CABundle:          str(ca),
+		ClientCertificate: str(writePEM(t, "client.pem", "CERTIFICATE", der)),
+		ClientKey:         str(writePEM(t, "client-key.pem", "PRIVATE KEY", keyDER)),
+	}).transport(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsGet(with, srv.URL); err != nil {
+		t.Errorf("GET with a client certificate = %v", err)
+	}
+}